@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// With -attempt-timeout, every attempt of an S3 request, including each of
+// the SDK's retries, gets its own deadline. An attempt that has not got a
+// response by then is abandoned and retried, as a failed connection would
+// be, instead of using up the -per-object-timeout of the whole transfer.
+// The deadline covers sending the request, including the body of uploads,
+// and waiting for the response's headers, but not reading its body, which
+// is bounded by -per-object-timeout alone.
+
+// attemptKey is the context key of the *attempt of a request.
+type attemptKey struct{}
+
+// attempt is the state of a single attempt of a request.
+type attempt struct {
+	timer    *time.Timer
+	cancel   context.CancelFunc
+	timedOut int32
+}
+
+// setAttemptTimeout bounds each attempt of an S3 request to d.
+func (b *s3Bin) setAttemptTimeout(d time.Duration) {
+	b.attemptTimeout = d
+	b.setRegion(aws.StringValue(b.s3Cli.Config.Region))
+}
+
+// startAttempt is a Send handler that gives the attempt about to be sent a
+// context of its own, canceled once the attempt times out. It is derived
+// from the context of the request, not from that of the previous attempt,
+// which may have been canceled.
+func (b *s3Bin) startAttempt(r *request.Request) {
+	ctx, cancel := context.WithCancel(r.Context())
+	a := &attempt{cancel: cancel}
+	a.timer = time.AfterFunc(b.attemptTimeout, func() {
+		atomic.StoreInt32(&a.timedOut, 1)
+		cancel()
+	})
+	r.HTTPRequest = r.HTTPRequest.WithContext(context.WithValue(ctx, attemptKey{}, a))
+}
+
+// endAttempt is a Send handler that stops the deadline of an attempt once
+// its response has arrived. An attempt that timed out is marked retryable:
+// the SDK would otherwise take the cancellation for the caller giving up.
+//
+// The context of a failed attempt is canceled, and the request given back
+// its own: the SDK signs the next attempt with the context of this one.
+func (b *s3Bin) endAttempt(r *request.Request) {
+	a, ok := r.HTTPRequest.Context().Value(attemptKey{}).(*attempt)
+	if !ok {
+		return
+	}
+
+	a.timer.Stop()
+	if r.Error == nil {
+		return
+	}
+
+	a.cancel()
+	r.HTTPRequest = r.HTTPRequest.WithContext(r.Context())
+	if atomic.LoadInt32(&a.timedOut) != 0 && r.Context().Err() == nil {
+		r.Error = awserr.New(request.ErrCodeRequestError,
+			"attempt timed out after "+b.attemptTimeout.String(), r.Error)
+		r.Retryable = aws.Bool(true)
+	}
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// storageClass returns the storage class of an uploaded object with size
+// bytes of content, or nil for the bucket's default.
+//
+// With -auto-tier, large objects are stored in INTELLIGENT_TIERING, which
+// moves objects that are not accessed to cheaper tiers. Small ones are
+// stored in STANDARD, since INTELLIGENT_TIERING never moves objects under
+// 128 KiB, and there is nothing to gain from it.
+func (b *s3Bin) storageClass(size int64) *string {
+	if b.autoTierThreshold == 0 {
+		return nil
+	}
+	if size >= b.autoTierThreshold {
+		return aws.String(s3.StorageClassIntelligentTiering)
+	}
+	return aws.String(s3.StorageClassStandard)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"log"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+)
+
+// createBucket creates the bucket in the client's region if it does not
+// exist yet. A bucket that already exists and is owned by the caller is not
+// an error.
+func (b *s3Bin) createBucket() error {
+	_, err := b.s3Cli.HeadBucket(&s3.HeadBucketInput{
+		Bucket: aws.String(b.s3Bucket),
+	})
+	if err == nil {
+		return nil
+	}
+
+	if reqErr, ok := err.(awserr.RequestFailure); !ok || reqErr.StatusCode() != 404 {
+		return errors.Wrapf(err, "failed to check S3 bucket %q", b.s3Bucket)
+	}
+
+	input := &s3.CreateBucketInput{
+		Bucket: aws.String(b.s3Bucket),
+	}
+
+	// us-east-1 is the default location, and S3 rejects it as an explicit
+	// location constraint.
+	region := aws.StringValue(b.s3Cli.Config.Region)
+	if region != "us-east-1" {
+		input.CreateBucketConfiguration = &s3.CreateBucketConfiguration{
+			LocationConstraint: aws.String(region),
+		}
+	}
+
+	_, err = b.s3Cli.CreateBucket(input)
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == s3.ErrCodeBucketAlreadyOwnedByYou {
+		return nil
+	} else if err != nil {
+		return errors.Wrapf(err, "failed to create S3 bucket %q", b.s3Bucket)
+	}
+
+	err = b.s3Cli.WaitUntilBucketExists(&s3.HeadBucketInput{
+		Bucket: aws.String(b.s3Bucket),
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed waiting for S3 bucket %q", b.s3Bucket)
+	}
+
+	log.Printf("Created S3 bucket %q in %s", b.s3Bucket, region)
+	return nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// capabilityXattr is the extended attribute that holds the file
+// capabilities of a file, as a struct vfs_cap_data.
+const capabilityXattr = "security.capability"
+
+// readCaps returns the file capabilities of path, or nil if it has none or
+// its file system does not support them.
+func readCaps(path string) ([]byte, error) {
+	caps, err := getXattrValue(func(dest []byte) (int, error) {
+		return syscall.Getxattr(path, capabilityXattr, dest)
+	})
+	if err == syscall.ENODATA || err == syscall.ENOTSUP {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %q", capabilityXattr)
+	}
+	return caps, nil
+}
+
+// writeCaps sets the file capabilities of path. Doing so requires
+// CAP_SETFCAP. They must be set after the file's content is written, which
+// clears them.
+func writeCaps(path string, caps []byte) error {
+	err := syscall.Setxattr(path, capabilityXattr, caps, 0)
+	if err == syscall.EPERM {
+		return errors.Wrapf(err, "failed to set %q, which requires CAP_SETFCAP",
+			capabilityXattr)
+	} else if err != nil {
+		return errors.Wrapf(err, "failed to set %q", capabilityXattr)
+	}
+	return nil
+}
@@ -0,0 +1,24 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"log"
+
+	"github.com/pkg/errors"
+)
+
+// capabilityXattr is not used on this platform; see caps_linux.go.
+const capabilityXattr = ""
+
+// readCaps is not supported on this platform. Files are put without their
+// capabilities.
+func readCaps(path string) ([]byte, error) {
+	log.Printf("File capabilities are not supported on this platform, skipping %q", path)
+	return nil, nil
+}
+
+func writeCaps(path string, caps []byte) error {
+	return errors.New("file capabilities are not supported on this platform")
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"log"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// checkSpace fails if the file system GetDir restores root to does not have
+// room for the files, checked by checkDirFiles, that it would download. The
+// size of each object's content is read from the beginning of the object;
+// objects whose content size is not recorded count with their stored size.
+// Existing files are truncated before they are replaced, so only the growth
+// of a file counts.
+func (b *s3Bin) checkSpace(root string, files []*dirFile) error {
+	targets := make(map[string][]string)
+	var hashes []string
+	for _, file := range files {
+		if file.done || (file.localErr == nil && file.localHash == file.hash) {
+			continue
+		}
+		if targets[file.hash] == nil {
+			hashes = append(hashes, file.hash)
+		}
+		targets[file.hash] = append(targets[file.hash], file.target)
+	}
+	if len(hashes) == 0 {
+		return nil
+	}
+
+	var (
+		mu     sync.Mutex
+		needed int64
+	)
+	err := b.forEachHash(hashes, func(hash string) error {
+		stat, err := b.statObject(hash)
+		if err != nil {
+			return err
+		}
+
+		size := stat.Size
+		if size < 0 {
+			size = stat.StoredSize
+		}
+
+		var growth int64
+		for _, file := range targets[hash] {
+			fstat, err := os.Stat(file)
+			if err == nil {
+				if size > fstat.Size() {
+					growth += size - fstat.Size()
+				}
+			} else if os.IsNotExist(err) {
+				growth += size
+			} else {
+				return errors.Wrapf(err, "failed to read attributes of %q", file)
+			}
+		}
+
+		mu.Lock()
+		needed += growth
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if b.addPathPrefix != "" {
+		root = b.addPathPrefix
+	}
+	available, err := freeSpace(root)
+	if err != nil {
+		return err
+	}
+
+	if needed > available {
+		return errors.Errorf(
+			"not enough free space to restore %q: need %d bytes, %d available",
+			root, needed, available)
+	}
+
+	log.Printf("Restoring %q needs up to %d bytes, %d available", root, needed, available)
+	return nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"hash"
+	"hash/crc32"
+	"io"
+	"log"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+)
+
+// parseS3Checksum validates the -s3-checksum flag.
+func parseS3Checksum(algorithm string) (string, error) {
+	algorithm = strings.ToUpper(algorithm)
+	for _, valid := range s3.ChecksumAlgorithm_Values() {
+		if algorithm == valid {
+			return algorithm, nil
+		}
+	}
+
+	return "", errors.Errorf("invalid -s3-checksum %q: must be one of %s",
+		algorithm, strings.Join(s3.ChecksumAlgorithm_Values(), ", "))
+}
+
+func newChecksumHash(algorithm string) hash.Hash {
+	switch algorithm {
+	case s3.ChecksumAlgorithmCrc32:
+		return crc32.NewIEEE()
+	case s3.ChecksumAlgorithmCrc32c:
+		return crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	case s3.ChecksumAlgorithmSha1:
+		return sha1.New()
+	case s3.ChecksumAlgorithmSha256:
+		return sha256.New()
+	default:
+		panic("unreachable")
+	}
+}
+
+// setPutChecksum computes the checksum of the body of input, and sets it so
+// that S3 rejects the upload if the body it receives does not match. The
+// SDK does not compute checksums itself.
+func setPutChecksum(input *s3.PutObjectInput, algorithm string) error {
+	h := newChecksumHash(algorithm)
+	_, err := io.Copy(h, input.Body)
+	if err != nil {
+		return errors.Wrap(err, "failed to read file")
+	}
+
+	_, err = input.Body.Seek(0, io.SeekStart)
+	if err != nil {
+		return errors.Wrap(err, "failed to rewind file")
+	}
+
+	checksum := aws.String(base64.StdEncoding.EncodeToString(h.Sum(nil)))
+
+	input.ChecksumAlgorithm = aws.String(algorithm)
+	switch algorithm {
+	case s3.ChecksumAlgorithmCrc32:
+		input.ChecksumCRC32 = checksum
+	case s3.ChecksumAlgorithmCrc32c:
+		input.ChecksumCRC32C = checksum
+	case s3.ChecksumAlgorithmSha1:
+		input.ChecksumSHA1 = checksum
+	case s3.ChecksumAlgorithmSha256:
+		input.ChecksumSHA256 = checksum
+	}
+
+	return nil
+}
+
+// checksumReadCloser checks the body of a GetObject response against the
+// checksum S3 returned for it, once the body has been read to the end.
+type checksumReadCloser struct {
+	io.ReadCloser
+	hash      hash.Hash
+	algorithm string
+	expected  string
+	err       error
+}
+
+// newChecksumReadCloser wraps the body of res to check it against whichever
+// checksum S3 returned, which depends on how the object was uploaded rather
+// than on -s3-checksum. If there is none, or it is a checksum of the parts
+// of a multipart upload rather than of the whole object, the body is
+// returned as-is.
+func newChecksumReadCloser(res *s3.GetObjectOutput, key string) io.ReadCloser {
+	checksums := []struct {
+		algorithm string
+		value     *string
+	}{
+		{s3.ChecksumAlgorithmCrc32, res.ChecksumCRC32},
+		{s3.ChecksumAlgorithmCrc32c, res.ChecksumCRC32C},
+		{s3.ChecksumAlgorithmSha1, res.ChecksumSHA1},
+		{s3.ChecksumAlgorithmSha256, res.ChecksumSHA256},
+	}
+
+	for _, checksum := range checksums {
+		expected := aws.StringValue(checksum.value)
+		if expected == "" {
+			continue
+		}
+
+		if strings.Contains(expected, "-") {
+			log.Printf("%q has a multipart checksum, which can't be verified", key)
+			return res.Body
+		}
+
+		return &checksumReadCloser{
+			ReadCloser: res.Body,
+			hash:       newChecksumHash(checksum.algorithm),
+			algorithm:  checksum.algorithm,
+			expected:   expected,
+		}
+	}
+
+	log.Printf("%q has no S3 checksum to verify", key)
+	return res.Body
+}
+
+func (c *checksumReadCloser) Read(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	n, err := c.ReadCloser.Read(p)
+	c.hash.Write(p[:n])
+
+	if err == io.EOF {
+		actual := base64.StdEncoding.EncodeToString(c.hash.Sum(nil))
+		if actual != c.expected {
+			err = errors.Errorf("S3 %s checksum mismatch: got %s, expected %s",
+				c.algorithm, actual, c.expected)
+		}
+	}
+
+	// Keep returning the result, so that the mismatch is reported however
+	// many times the end of the body is read.
+	if err != nil {
+		c.err = err
+	}
+
+	return n, err
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+)
+
+// With -chunked, files are split into chunks at boundaries chosen by their
+// content (content-defined chunking), so that an insertion or deletion only
+// changes the chunks around it. Each chunk is stored as an ordinary object
+// keyed by the chunk's own hash, so chunks shared by versions of a file, or
+// by different files, are stored once. The object for the file's hash is a
+// chunk manifest.
+//
+// Boundaries are found with a gear hash: a boundary follows the first byte,
+// at least chunkMinSize bytes into the chunk, after which the top chunkBits
+// bits of the hash are zero. Chunks average about chunkMinSize +
+// 2^chunkBits bytes.
+const (
+	chunkMinSize = 256 << 10
+	chunkMaxSize = 4 << 20
+	chunkBits    = 20
+)
+
+const chunkManifestVersion = 1
+
+// gearTable maps bytes to the random values mixed into the gear hash. It is
+// generated with splitmix64 from a fixed seed, and must not change: that
+// would move chunk boundaries, and defeat deduplication against chunks
+// that are already stored.
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	x := uint64(0x73336269)
+	for i := range table {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// chunkManifest is the content of a chunked object.
+type chunkManifest struct {
+	Version int         `json:"version"`
+	Header  *Header     `json:"header"`
+	Size    int64       `json:"size"`
+	Mode    os.FileMode `json:"mode"`
+	Chunks  []chunkRef  `json:"chunks"`
+}
+
+// chunkRef is a chunk of a chunked object.
+type chunkRef struct {
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+// splitChunks splits the content read from r into chunks, and calls fn for
+// each of them in order. The chunk given to fn is only valid until fn
+// returns.
+func splitChunks(r io.Reader, fn func(chunk []byte) error) error {
+	br := bufio.NewReaderSize(r, 64<<10)
+	chunk := make([]byte, 0, chunkMaxSize)
+	var h uint64
+	for {
+		c, err := br.ReadByte()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		chunk = append(chunk, c)
+		h = (h << 1) + gearTable[c]
+		if (len(chunk) >= chunkMinSize && h>>(64-chunkBits) == 0) ||
+			len(chunk) == chunkMaxSize {
+			err = fn(chunk)
+			if err != nil {
+				return err
+			}
+			chunk = chunk[:0]
+			h = 0
+		}
+	}
+
+	if len(chunk) > 0 {
+		return fn(chunk)
+	}
+	return nil
+}
+
+// putChunked uploads size bytes of content read from f as a chunked object
+// for hash. Only chunks that are not already stored are uploaded.
+func (b *s3Bin) putChunked(hash string, header *Header, f io.ReadSeeker, size int64, mode os.FileMode, name string) error {
+	manifest := &chunkManifest{
+		Version: chunkManifestVersion,
+		Header:  header,
+		Size:    size,
+		Mode:    mode,
+	}
+
+	seen := make(map[string]bool)
+	uploaded := 0
+	err := splitChunks(f, func(chunk []byte) error {
+		sum := sha1.Sum(chunk)
+		chunkHash := hex.EncodeToString(sum[:])
+		manifest.Chunks = append(manifest.Chunks, chunkRef{
+			Hash: chunkHash,
+			Size: int64(len(chunk)),
+		})
+
+		// A file that is a single chunk is stored as an ordinary object
+		// below, since its chunk would have the same key as its manifest.
+		if chunkHash == hash || seen[chunkHash] {
+			return nil
+		}
+		seen[chunkHash] = true
+
+		exists, err := b.objectExists(chunkHash)
+		if err != nil {
+			return err
+		}
+		if exists {
+			if b.paranoid {
+				return b.compareObject(chunkHash, chunk)
+			}
+			return nil
+		}
+
+		metadata, body, err := b.packContent(
+			&Header{Version: version}, bytes.NewReader(chunk), int64(len(chunk)), 0644)
+		if err != nil {
+			return err
+		}
+
+		key, err := b.objectKey(chunkHash)
+		if err != nil {
+			return err
+		}
+
+		uploaded++
+		return b.storeObject(key, chunkHash, metadata, body,
+			int64(len(chunk)), fmt.Sprintf("%s (chunk %s)", name, chunkHash))
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to put chunks of %q", name)
+	}
+
+	if len(manifest.Chunks) <= 1 {
+		_, err = f.Seek(0, io.SeekStart)
+		if err != nil {
+			return errors.Wrap(err, "failed to rewind file")
+		}
+		return b.putObject(hash, header, f, size, mode, name)
+	}
+
+	log.Printf("Uploaded %d of %d chunks of %q", uploaded, len(manifest.Chunks), name)
+
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return errors.Wrap(err, "json.Marshal(manifest)")
+	}
+
+	key, err := b.objectKey(hash)
+	if err != nil {
+		return err
+	}
+	err = b.storeObject(key, hash, formatOnly(formatChunked), bytes.NewReader(data),
+		int64(len(data)), name)
+	if err != nil {
+		return err
+	}
+
+	atomic.AddInt64(&b.stats.FilesUploaded, 1)
+	return b.verifyPut(key, hash, name)
+}
+
+// objectExists returns whether the object for hash is stored.
+func (b *s3Bin) objectExists(hash string) (bool, error) {
+	key, err := b.objectKey(hash)
+	if err != nil {
+		return false, err
+	}
+	return b.keyExists(key)
+}
+
+// keyExists returns whether there is an object at key.
+func (b *s3Bin) keyExists(key string) (bool, error) {
+	_, err := b.s3Cli.HeadObject(&s3.HeadObjectInput{
+		Bucket:       aws.String(b.s3Bucket),
+		Key:          aws.String(key),
+		RequestPayer: b.requestPayer,
+	})
+	if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() == 404 {
+		return false, nil
+	} else if err != nil {
+		return false, errors.Wrapf(err, "failed to check %q in S3 bucket %q",
+			key, b.s3Bucket)
+	}
+	return true, nil
+}
+
+// openChunked opens the content of a chunked object, whose manifest is read
+// from r. body is the object's body.
+func (b *s3Bin) openChunked(ctx context.Context, r io.Reader, body io.Reader) (*objectContent, error) {
+	manifest := &chunkManifest{}
+	var err error
+	if b.strictFormat {
+		err = decodeStrict(r, manifest)
+	} else {
+		err = json.NewDecoder(r).Decode(manifest)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read chunk manifest")
+	}
+
+	if manifest.Version != chunkManifestVersion {
+		return nil, errors.Errorf(
+			"unsupported chunk manifest version %d", manifest.Version)
+	}
+
+	return &objectContent{
+		format:   formatChunked,
+		header:   manifest.Header,
+		manifest: manifest,
+		mode:     manifest.Mode,
+		hasMode:  true,
+		size:     manifest.Size,
+		data: &chunkReader{
+			b:      b,
+			ctx:    ctx,
+			chunks: manifest.Chunks,
+		},
+		body: body,
+	}, nil
+}
+
+// chunkReader reads the content of a chunked object, downloading its chunks
+// in turn. Each chunk is checked against its hash and size.
+type chunkReader struct {
+	b      *s3Bin
+	ctx    context.Context
+	chunks []chunkRef
+
+	// local, if set, is a previous version of the file. Chunks found in
+	// localChunks, which maps their hashes to their offsets in local, are
+	// read from it instead of downloaded.
+	local       *os.File
+	localChunks map[string]int64
+
+	// cur is the chunk being read, or nil between chunks.
+	cur    io.Reader
+	ref    chunkRef
+	hash   hash.Hash
+	n      int64
+	finish func() error
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if r.cur == nil {
+			if len(r.chunks) == 0 {
+				return 0, io.EOF
+			}
+
+			err := r.openChunk()
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		n, err := r.cur.Read(p)
+		r.hash.Write(p[:n])
+		r.n += int64(n)
+		if err != io.EOF {
+			return n, err
+		}
+
+		err = r.closeChunk()
+		if err != nil || n > 0 {
+			return n, err
+		}
+	}
+}
+
+func (r *chunkReader) openChunk() error {
+	r.ref = r.chunks[0]
+	r.chunks = r.chunks[1:]
+	r.hash = sha1.New()
+	r.n = 0
+
+	if offset, ok := r.localChunks[r.ref.Hash]; ok {
+		r.cur = io.NewSectionReader(r.local, offset, r.ref.Size)
+		r.finish = nil
+		return nil
+	}
+
+	key, err := r.b.objectKey(r.ref.Hash)
+	if err != nil {
+		return err
+	}
+	res, err := r.b.getObject(r.ctx, key)
+	if err != nil {
+		return err
+	}
+
+	content, err := r.b.openContent(r.ctx, res)
+	if err == nil && content.manifest != nil {
+		err = errors.New("chunk is itself chunked")
+	}
+	if err != nil {
+		res.Body.Close()
+		return errors.Wrapf(err, "failed to read chunk %s", r.ref.Hash)
+	}
+
+	r.cur = content.data
+	r.finish = func() error {
+		defer res.Body.Close()
+		return content.finish()
+	}
+	return nil
+}
+
+func (r *chunkReader) closeChunk() error {
+	r.cur = nil
+	if r.finish != nil {
+		err := r.finish()
+		if err != nil {
+			return errors.Wrapf(err, "failed to read chunk %s", r.ref.Hash)
+		}
+	}
+
+	actual := hex.EncodeToString(r.hash.Sum(nil))
+	if r.n != r.ref.Size || actual != r.ref.Hash {
+		return errors.Wrapf(ErrHashMismatch, "chunk %s is corrupt: read %d bytes with hash %s",
+			r.ref.Hash, r.n, actual)
+	}
+	return nil
+}
+
+// reuseLocal makes r read the chunks it shares with targetFile, the
+// previous version of the file, from it instead of downloading them.
+// targetFile is moved aside while the new version is written in its place.
+// The returned function must be called once the download is over: it
+// removes the previous version, or if the download failed and left no
+// file behind, moves it back.
+func (r *chunkReader) reuseLocal(targetFile string) (func(), error) {
+	prevFile := targetFile + ".s3bin-prev"
+	err := os.Rename(targetFile, prevFile)
+	if os.IsNotExist(err) {
+		return func() {}, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "failed to move %q aside", targetFile)
+	}
+
+	done := func() {
+		if r.local != nil {
+			r.local.Close()
+		}
+		if _, err := os.Lstat(targetFile); os.IsNotExist(err) {
+			os.Rename(prevFile, targetFile)
+		} else {
+			os.Remove(prevFile)
+		}
+	}
+
+	r.local, err = os.Open(prevFile)
+	if err != nil {
+		done()
+		return nil, errors.Wrapf(err, "failed to open %q", prevFile)
+	}
+
+	localChunks := make(map[string]int64)
+	offset := int64(0)
+	err = splitChunks(r.local, func(chunk []byte) error {
+		sum := sha1.Sum(chunk)
+		localChunks[hex.EncodeToString(sum[:])] = offset
+		offset += int64(len(chunk))
+		return nil
+	})
+	if err != nil {
+		done()
+		return nil, errors.Wrapf(err, "failed to read %q", prevFile)
+	}
+
+	reused := 0
+	for _, ref := range r.chunks {
+		if _, ok := localChunks[ref.Hash]; ok {
+			reused++
+		}
+	}
+	log.Printf("Reusing %d of %d chunks of %q", reused, len(r.chunks), targetFile)
+
+	r.localChunks = localChunks
+	return done, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"log"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// compareBlockSize is the size of the blocks Compare reads from the object
+// and the local file at once.
+const compareBlockSize = 64 << 10
+
+// Compare checks that the object stored for the hash of the local file
+// decompresses to the file's exact content, without a .sha1 file. The
+// object is streamed, and compared with the file byte for byte. It fails
+// if the object is missing, or if any byte differs: with ErrHashCollision
+// if the object's content still has the file's hash, and ErrHashMismatch
+// if it is corrupt.
+func (b *s3Bin) Compare(file string) error {
+	hash, err := calcSha1(file, b.ioBufferSize)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return errors.Wrap(err, "failed to open file")
+	}
+	defer f.Close()
+
+	ctx, cancel := b.objectContext()
+	defer cancel()
+
+	key, err := b.objectKey(hash)
+	if err != nil {
+		return err
+	}
+	res, err := b.getObject(ctx, key)
+	if err != nil {
+		return errors.Wrapf(err, "no object for %q", file)
+	}
+	defer res.Body.Close()
+
+	content, err := b.openContent(ctx, res)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read %q", key)
+	}
+
+	h := sha1.New()
+	offset, same, err := compareReaders(io.TeeReader(content.data, h), f)
+	if err != nil {
+		return errors.Wrapf(err, "failed to compare %q with %q", key, file)
+	}
+
+	if same {
+		err = content.finish()
+		if err != nil {
+			return errors.Wrapf(err, "failed to read %q", key)
+		}
+		log.Printf("%q matches %q", file, key)
+		return nil
+	}
+
+	// Hash the rest of the object, to tell a collision from corruption.
+	_, err = io.Copy(h, content.data)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read %q", key)
+	}
+
+	if hex.EncodeToString(h.Sum(nil)) == hash {
+		return errors.Wrapf(ErrHashCollision,
+			"object %q has the hash of %q but differs from it at byte %d", key, file, offset)
+	}
+	return errors.Wrapf(ErrHashMismatch,
+		"object %q is corrupt: it differs from %q at byte %d", key, file, offset)
+}
+
+// compareReaders reads a and b to the end, or until they differ. It returns
+// whether they are the same, and if not, the offset of the first byte that
+// differs, or the length of the shorter one.
+func compareReaders(a, b io.Reader) (int64, bool, error) {
+	bufA := make([]byte, compareBlockSize)
+	bufB := make([]byte, compareBlockSize)
+	var offset int64
+	for {
+		nA, errA := io.ReadFull(a, bufA)
+		if errA != nil && errA != io.EOF && errA != io.ErrUnexpectedEOF {
+			return 0, false, errA
+		}
+		nB, errB := io.ReadFull(b, bufB)
+		if errB != nil && errB != io.EOF && errB != io.ErrUnexpectedEOF {
+			return 0, false, errB
+		}
+
+		if !bytes.Equal(bufA[:nA], bufB[:nB]) {
+			n := nA
+			if nB < n {
+				n = nB
+			}
+			i := 0
+			for i < n && bufA[i] == bufB[i] {
+				i++
+			}
+			return offset + int64(i), false, nil
+		}
+		offset += int64(nA)
+
+		if nA < len(bufA) {
+			return offset, true, nil
+		}
+	}
+}
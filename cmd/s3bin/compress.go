@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// rawMode is the mode of files created by downloading raw objects, which do
+// not store one, under the usual umask.
+const rawMode os.FileMode = 0644
+
+// autoBestCodec is the codec recorded in the Header of objects packed by
+// -compress auto-best.
+const autoBestCodec = "gzip"
+
+// packBest returns the smallest of the objects for size bytes of content
+// read from r in the formats and compression levels -compress auto-best
+// tries: tar.gz and gzip, each at the default and the best compression
+// level, and raw. The header of the winner records its codec and level.
+// Gzip is only tried if the header fits in object metadata, and raw only if
+// it loses nothing: it stores neither the header nor the mode.
+//
+// Every candidate is held in memory, and compressing at the best level is
+// slow, so content larger than autoBestMaxSize is packed in the default
+// format without trying others.
+func (b *s3Bin) packBest(header *Header, r io.ReadSeeker, size int64, mode os.FileMode) (map[string]*string, io.ReadSeeker, error) {
+	if size > b.autoBestMaxSize {
+		archive, err := b.packObject(header, r, size, mode)
+		if err != nil {
+			return nil, nil, err
+		}
+		return formatOnly(formatTarGz), bytes.NewReader(archive), nil
+	}
+
+	var bestMetadata map[string]*string
+	var best io.ReadSeeker
+	bestSize := int64(-1)
+	consider := func(metadata map[string]*string, body io.ReadSeeker) error {
+		n, err := body.Seek(0, io.SeekEnd)
+		if err == nil {
+			_, err = body.Seek(0, io.SeekStart)
+		}
+		if err != nil {
+			return errors.Wrap(err, "failed to read object size")
+		}
+		if bestSize < 0 || n < bestSize {
+			bestMetadata, best, bestSize = metadata, body, n
+		}
+		return nil
+	}
+
+	for _, level := range []int{gzip.DefaultCompression, gzip.BestCompression} {
+		candidate := *header
+		candidate.Codec = autoBestCodec
+		candidate.Level = level
+
+		_, err := r.Seek(0, io.SeekStart)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "failed to rewind file")
+		}
+		archive, err := b.packObjectLevel(&candidate, r, size, mode, level)
+		if err != nil {
+			return nil, nil, err
+		}
+		err = consider(formatOnly(formatTarGz), bytes.NewReader(archive))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		_, err = r.Seek(0, io.SeekStart)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "failed to rewind file")
+		}
+		metadata, body, err := packGzipLevel(&candidate, r, size, mode, b.ioBufferSize, level)
+		if errors.Cause(err) == errHeaderTooLarge {
+			continue
+		} else if err != nil {
+			return nil, nil, err
+		}
+		err = consider(metadata, body)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	lossless := len(header.XAttrs) == 0 && len(header.Caps) == 0 && header.Name == "" && mode == rawMode
+	if lossless && size <= bestSize {
+		_, err := r.Seek(0, io.SeekStart)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "failed to rewind file")
+		}
+		return formatOnly(formatRaw), r, nil
+	}
+
+	return bestMetadata, best, nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+)
+
+// DedupReport describes how much space content addressing would save for a
+// directory tree.
+type DedupReport struct {
+	Files       int          `json:"files"`
+	Bytes       int64        `json:"bytes"`
+	UniqueFiles int          `json:"unique_files"`
+	UniqueBytes int64        `json:"unique_bytes"`
+	Duplicates  []DedupGroup `json:"duplicates"`
+}
+
+// DedupGroup is a set of files with the same content.
+type DedupGroup struct {
+	Hash  string   `json:"hash"`
+	Size  int64    `json:"size"`
+	Paths []string `json:"paths"`
+}
+
+// buildDedupReport hashes every regular file under root, other than .sha1
+// files, and groups them by hash.
+func buildDedupReport(root string, bufSize int) (*DedupReport, error) {
+	groups := make(map[string]*DedupGroup)
+	report := &DedupReport{}
+
+	err := filepath.Walk(
+		root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			if !info.Mode().IsRegular() || filepath.Ext(path) == ".sha1" {
+				return nil
+			}
+
+			hash, err := calcSha1(path, bufSize)
+			if err != nil {
+				return errors.Wrapf(err, "failed to hash %q", path)
+			}
+
+			report.Files++
+			report.Bytes += info.Size()
+
+			group, ok := groups[hash]
+			if !ok {
+				group = &DedupGroup{Hash: hash, Size: info.Size()}
+				groups[hash] = group
+				report.UniqueFiles++
+				report.UniqueBytes += info.Size()
+			}
+			group.Paths = append(group.Paths, path)
+
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, group := range groups {
+		if len(group.Paths) > 1 {
+			report.Duplicates = append(report.Duplicates, *group)
+		}
+	}
+
+	// Largest savings first.
+	sort.Slice(report.Duplicates, func(i, j int) bool {
+		di, dj := report.Duplicates[i], report.Duplicates[j]
+		si := di.Size * int64(len(di.Paths)-1)
+		sj := dj.Size * int64(len(dj.Paths)-1)
+		if si != sj {
+			return si > sj
+		}
+		return di.Hash < dj.Hash
+	})
+
+	return report, nil
+}
+
+func dedupReport(w io.Writer, root string, asJSON bool, bufSize int) error {
+	report, err := buildDedupReport(root, bufSize)
+	if err != nil {
+		return err
+	}
+
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	if len(report.Duplicates) > 0 {
+		fmt.Fprintf(tw, "HASH\tSIZE\tCOPIES\n")
+		for _, group := range report.Duplicates {
+			fmt.Fprintf(tw, "%s\t%d\t%d\n", group.Hash, group.Size, len(group.Paths))
+		}
+		fmt.Fprintf(tw, "\n")
+	}
+
+	saved := 0.0
+	if report.Bytes > 0 {
+		saved = 100 * float64(report.Bytes-report.UniqueBytes) / float64(report.Bytes)
+	}
+
+	fmt.Fprintf(tw, "Total:\t%d files\t%d bytes\n", report.Files, report.Bytes)
+	fmt.Fprintf(tw, "Unique:\t%d files\t%d bytes\n", report.UniqueFiles, report.UniqueBytes)
+	fmt.Fprintf(tw, "Saved:\t%.1f%%\t%d bytes\n", saved, report.Bytes-report.UniqueBytes)
+
+	return tw.Flush()
+}
@@ -0,0 +1,13 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux
+// +build !darwin,!dragonfly,!freebsd,!linux
+
+package main
+
+import (
+	"github.com/pkg/errors"
+)
+
+// freeSpace is not supported on this platform.
+func freeSpace(path string) (int64, error) {
+	return 0, errors.New("-check-space is not supported on this platform")
+}
@@ -0,0 +1,21 @@
+//go:build darwin || dragonfly || freebsd || linux
+// +build darwin dragonfly freebsd linux
+
+package main
+
+import (
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// freeSpace returns the number of bytes available to unprivileged users on
+// the file system holding path.
+func freeSpace(path string) (int64, error) {
+	var st syscall.Statfs_t
+	err := syscall.Statfs(path, &st)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to read free space of %q", path)
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// DumpObject saves the stored object for file to outFile exactly as it is
+// stored, e.g. as a tar.gz, so that it can be inspected with other tools.
+// file is a .sha1 file, or with -lock-file, the file itself.
+func (b *s3Bin) DumpObject(file, outFile string) error {
+	hash, err := b.recordedHash(file)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := b.objectContext()
+	defer cancel()
+
+	key, err := b.objectKey(hash)
+	if err != nil {
+		return err
+	}
+	res, err := b.getObjectVersion(ctx, key, b.versionID)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	f, err := os.Create(outFile)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create %q", outFile)
+	}
+	defer f.Close()
+
+	n, err := io.Copy(f, res.Body)
+	if err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		os.Remove(outFile)
+		return errors.Wrapf(err, "failed to save %q to %q", key, outFile)
+	}
+
+	format := metadataValue(res.Metadata, formatMetadata)
+	if format == "" {
+		format = "unknown"
+	}
+	log.Printf("Saved %q (%d bytes, format %s) to %q", key, n, format, outFile)
+	return nil
+}
+
+// headerRange is the range of the object DumpHeader downloads first, which
+// holds the header of all but objects with very large headers.
+const headerRange = "bytes=0-65535"
+
+// DumpHeader prints the header of the stored object for file to w as JSON.
+// Only the beginning of the object is downloaded, unless the header does not
+// fit in it. file is a .sha1 file, or with -lock-file, the file itself.
+func (b *s3Bin) DumpHeader(w io.Writer, file string) error {
+	hash, err := b.recordedHash(file)
+	if err != nil {
+		return err
+	}
+
+	key, err := b.objectKey(hash)
+	if err != nil {
+		return err
+	}
+	header, err := b.readHeader(key, headerRange)
+	if err != nil && errors.Cause(err) != ErrObjectNotFound {
+		// The header may be cut off by the range, and S3 rejects ranges of
+		// empty objects.
+		header, err = b.readHeader(key, "")
+	}
+	if err != nil {
+		return err
+	}
+	if header == nil {
+		return errors.Errorf("object %q has no header", key)
+	}
+
+	data, err := json.MarshalIndent(header, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "json.MarshalIndent(header)")
+	}
+	_, err = fmt.Fprintf(w, "%s\n", data)
+	return err
+}
+
+// readHeader returns the header of the object at key, read from the byte
+// range rng of the object, or nil if its format has none.
+func (b *s3Bin) readHeader(key, rng string) (*Header, error) {
+	ctx, cancel := b.objectContext()
+	defer cancel()
+
+	res, err := b.getObjectRange(ctx, key, b.versionID, rng)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	content, err := b.openContent(ctx, res)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %q", key)
+	}
+	return content.header, nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+)
+
+// The causes of errors that callers may need to tell apart. Errors are
+// returned wrapped, with context; match them with errors.Cause or
+// errors.Is.
+var (
+	// ErrObjectNotFound is returned when the object for a hash, or the
+	// requested version of it, is not stored.
+	ErrObjectNotFound = errors.New("object not found")
+
+	// ErrHashMismatch is returned when downloaded content, or a chunk of
+	// it, does not have the hash it was expected to have.
+	ErrHashMismatch = errors.New("hash mismatch")
+
+	// ErrHashCollision is returned by -paranoid when content has the hash
+	// of an object that is already stored, but not its content.
+	ErrHashCollision = errors.New("hash collision")
+
+	// ErrInvalidSidecar is returned when a .sha1 file does not hold a
+	// valid hash, or a file given as one does not have the .sha1
+	// extension.
+	ErrInvalidSidecar = errors.New("invalid .sha1 file")
+
+	// ErrNotLocked is returned when a file has no entry in the lock file
+	// given with -lock-file.
+	ErrNotLocked = errors.New("no lock file entry")
+)
+
+// isNotFound returns whether err, returned by a GetObject request, is S3
+// reporting that the object or its version does not exist.
+func isNotFound(err error) bool {
+	aerr, ok := errors.Cause(err).(awserr.Error)
+	return ok && (aerr.Code() == s3.ErrCodeNoSuchKey || aerr.Code() == "NoSuchVersion")
+}
+
+// isAccessDenied returns whether err is S3 refusing a request for lack of
+// permission.
+func isAccessDenied(err error) bool {
+	aerr, ok := errors.Cause(err).(awserr.Error)
+	return ok && aerr.Code() == "AccessDenied"
+}
@@ -0,0 +1,68 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// staleLockAge is the age after which a lock is taken to be left
+	// behind by a process that died holding it. Locks are only held while
+	// a small file is rewritten.
+	staleLockAge = time.Minute
+
+	// lockTimeout is how long acquireFileLock waits for a lock.
+	lockTimeout = 2 * time.Minute
+)
+
+type fileLock struct {
+	path string
+}
+
+// acquireFileLock blocks until it holds an exclusive lock on path. Platforms
+// without flock fall back to exclusively creating path, which records the
+// PID of its holder and is removed on release. A lock older than
+// staleLockAge is removed, and acquireFileLock fails if the lock is not
+// released within lockTimeout.
+func acquireFileLock(path string) (*fileLock, error) {
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			fmt.Fprintf(f, "%d\n", os.Getpid())
+			f.Close()
+			return &fileLock{path: path}, nil
+		}
+		if !os.IsExist(err) {
+			return nil, errors.Wrapf(err, "failed to create lock %q", path)
+		}
+
+		if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) > staleLockAge {
+			os.Remove(path)
+			continue
+		}
+
+		if time.Now().After(deadline) {
+			holder := "another process"
+			if data, err := ioutil.ReadFile(path); err == nil && len(data) > 0 {
+				holder = "process " + strings.TrimSpace(string(data))
+			}
+			return nil, errors.Errorf(
+				"timed out after %v waiting for lock %q held by %s; remove it if that process is gone",
+				lockTimeout, path, holder)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func (l *fileLock) release() {
+	os.Remove(l.path)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+)
+
+// formatMetadata is the object metadata key that records the format an
+// object is stored in.
+const formatMetadata = "s3bin-format"
+
+// hashMetadata is the object metadata key that records the hash of an
+// object's content, which is needed to verify objects stored under keys
+// other than their hash, as with -put-key.
+const hashMetadata = "s3bin-sha1"
+
+const (
+	// formatTarGz objects are a gzipped tar with a "header" and a "data"
+	// member. This is the default format.
+	formatTarGz = "tar.gz"
+
+	// formatRaw objects hold the file's bytes as-is, so that they can be
+	// fetched with any S3 client.
+	formatRaw = "raw"
+
+	// formatGzip objects are the file's bytes gzipped, without a tar
+	// wrapper, so that they can be fetched and decompressed with common
+	// tools. The header and mode are stored in object metadata instead.
+	formatGzip = "gzip"
+
+	// formatChunked objects are a JSON chunk manifest, which lists the
+	// objects of the chunks the file was split in. See chunked.go.
+	formatChunked = "chunked"
+)
+
+// objectContent is the content of a stored object, opened for reading.
+type objectContent struct {
+	// format is the format the object is stored in.
+	format string
+
+	// header is the object's header, or nil if its format has none.
+	header *Header
+
+	// manifest is the chunk manifest of chunked objects.
+	manifest *chunkManifest
+
+	// mode is the file mode stored with the content, if hasMode is set.
+	mode    os.FileMode
+	hasMode bool
+
+	// size is the size of the content, or -1 if it is unknown.
+	size int64
+
+	data io.Reader
+
+	// tar, if set, is the tar reader data is read from.
+	tar *tar.Reader
+
+	// strict is set if the end of the object is checked by -strict-format.
+	strict bool
+
+	// stream, if set, is the decompressed stream data is read from. The
+	// gzip reader only checks the stream's CRC once it is read to the end.
+	stream io.Reader
+
+	// body is the object's body, which data is read from.
+	body io.Reader
+}
+
+// openContent opens the content of a downloaded object. The object's format
+// is taken from its metadata. Objects without format metadata, e.g. those
+// uploaded by older versions or by other tools, are sniffed: anything that
+// does not start with the gzip magic bytes is taken to be raw. The chunks of
+// chunked objects are downloaded with ctx as the content is read.
+func (b *s3Bin) openContent(ctx context.Context, res *s3.GetObjectOutput) (*objectContent, error) {
+	body := bufio.NewReader(res.Body)
+
+	format := metadataValue(res.Metadata, formatMetadata)
+	if format == "" {
+		// Peek fails for objects shorter than the magic bytes. Those can
+		// only be raw, which includes the empty object of an empty file.
+		magic, err := body.Peek(2)
+		if err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+			format = formatTarGz
+		} else {
+			format = formatRaw
+		}
+	}
+
+	if b.strictFormat && format != formatTarGz && format != formatRaw &&
+		format != formatGzip && format != formatChunked {
+		return nil, errors.Errorf("%s: unknown format %q", strictFormatError, format)
+	}
+
+	if format == formatChunked {
+		return b.openChunked(ctx, body, res.Body)
+	}
+
+	if format == formatGzip {
+		return b.openGzip(res.Metadata, body)
+	}
+
+	if format == formatRaw {
+		size := int64(-1)
+		if res.ContentLength != nil {
+			size = *res.ContentLength
+		}
+
+		return &objectContent{
+			format: formatRaw,
+			size:   size,
+			data:   body,
+			body:   res.Body,
+		}, nil
+	}
+
+	gzipReader, err := gzip.NewReader(body)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create gzip reader")
+	}
+
+	if b.strictFormat {
+		// Anything after the first gzip member is trailing garbage.
+		gzipReader.Multistream(false)
+	}
+
+	header, tarHdr, data, err := openObject(gzipReader, b.strictFormat)
+	if err != nil {
+		return nil, err
+	}
+
+	return &objectContent{
+		format:  formatTarGz,
+		header:  header,
+		mode:    os.FileMode(tarHdr.Mode),
+		hasMode: true,
+		size:    tarHdr.Size,
+		data:    data,
+		tar:     data,
+		strict:  b.strictFormat,
+		stream:  gzipReader,
+		body:    body,
+	}, nil
+}
+
+// checkSize returns an error if n, the number of bytes read from the
+// content, does not match its expected size. This catches truncated
+// downloads whether or not the content's hash is checked.
+func (c *objectContent) checkSize(n int64) error {
+	if c.size >= 0 && n != c.size {
+		return errors.Errorf("content is truncated: read %d of %d bytes", n, c.size)
+	}
+	return nil
+}
+
+// finish reads whatever is left of the object after its content, so that
+// checks done at the end of the object, like the gzip CRC and S3
+// checksums, take place.
+func (c *objectContent) finish() error {
+	if c.strict {
+		return c.finishStrict()
+	}
+
+	if c.stream != nil {
+		_, err := io.Copy(ioutil.Discard, c.stream)
+		if err != nil {
+			return errors.Wrap(err, "failed to decompress object")
+		}
+	}
+
+	_, err := io.Copy(ioutil.Discard, c.body)
+	return err
+}
+
+// formatOnly returns the metadata of an object in format that needs no
+// other metadata.
+func formatOnly(format string) map[string]*string {
+	return map[string]*string{
+		formatMetadata: aws.String(format),
+	}
+}
+
+// metadataValue returns the value of an object metadata key. The SDK
+// canonicalizes the case of metadata keys in responses, so the key is
+// matched case-insensitively.
+func metadataValue(metadata map[string]*string, key string) string {
+	for k, v := range metadata {
+		if strings.EqualFold(k, key) {
+			return aws.StringValue(v)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// emptyObject is a stored object of an empty file.
+type emptyObject struct {
+	name     string
+	metadata map[string]*string
+	body     []byte
+	format   string
+	hasMode  bool
+}
+
+func emptyObjects(t *testing.T, b *s3Bin, mode os.FileMode) []emptyObject {
+	header := &Header{Version: version}
+
+	archive, err := b.packObject(header, bytes.NewReader(nil), 0, mode)
+	if err != nil {
+		t.Fatalf("packObject: %v", err)
+	}
+
+	gzipMetadata, gzipBody, err := packGzip(header, bytes.NewReader(nil), 0, mode, 0)
+	if err != nil {
+		t.Fatalf("packGzip: %v", err)
+	}
+	gzipped, err := ioutil.ReadAll(gzipBody)
+	if err != nil {
+		t.Fatalf("reading packGzip body: %v", err)
+	}
+
+	return []emptyObject{
+		{"tar.gz", formatOnly(formatTarGz), archive, formatTarGz, true},
+		{"tar.gz without metadata", nil, archive, formatTarGz, true},
+		{"gzip", gzipMetadata, gzipped, formatGzip, true},
+		{"raw", formatOnly(formatRaw), nil, formatRaw, false},
+		{"raw without metadata", nil, nil, formatRaw, false},
+	}
+}
+
+func TestOpenContentEmpty(t *testing.T) {
+	const mode = os.FileMode(0750)
+
+	for _, strict := range []bool{false, true} {
+		b := &s3Bin{strictFormat: strict}
+		for _, obj := range emptyObjects(t, b, mode) {
+			res := &s3.GetObjectOutput{
+				Metadata:      obj.metadata,
+				ContentLength: aws.Int64(int64(len(obj.body))),
+				Body:          ioutil.NopCloser(bytes.NewReader(obj.body)),
+			}
+
+			content, err := b.openContent(context.Background(), res)
+			if err != nil {
+				t.Errorf("%s (strict %v): openContent: %v", obj.name, strict, err)
+				continue
+			}
+
+			if content.format != obj.format {
+				t.Errorf("%s (strict %v): format is %q, want %q",
+					obj.name, strict, content.format, obj.format)
+			}
+			if content.size != 0 {
+				t.Errorf("%s (strict %v): size is %d, want 0", obj.name, strict, content.size)
+			}
+			if content.hasMode != obj.hasMode {
+				t.Errorf("%s (strict %v): hasMode is %v, want %v",
+					obj.name, strict, content.hasMode, obj.hasMode)
+			} else if obj.hasMode && content.mode != mode {
+				t.Errorf("%s (strict %v): mode is %v, want %v",
+					obj.name, strict, content.mode, mode)
+			}
+
+			n, err := io.Copy(ioutil.Discard, content.data)
+			if err != nil {
+				t.Errorf("%s (strict %v): reading content: %v", obj.name, strict, err)
+				continue
+			}
+			if n != 0 {
+				t.Errorf("%s (strict %v): read %d bytes, want 0", obj.name, strict, n)
+			}
+
+			err = content.checkSize(n)
+			if err != nil {
+				t.Errorf("%s (strict %v): checkSize: %v", obj.name, strict, err)
+			}
+			err = content.finish()
+			if err != nil {
+				t.Errorf("%s (strict %v): finish: %v", obj.name, strict, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+)
+
+// GetReader returns a reader of the content of the file for file, a .sha1
+// file or with -lock-file, the file itself, as it is downloaded. The
+// content is checked against its hash as it is read: the reader returns an
+// error instead of io.EOF if the content is corrupt, so callers must not
+// trust the content before reading it to the end. The reader must be
+// closed.
+func (b *s3Bin) GetReader(file string) (io.ReadCloser, error) {
+	hash, err := b.recordedHash(file)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := b.objectKey(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := b.objectContext()
+	res, err := b.getObjectVersion(ctx, key, b.versionID)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	content, err := b.openContent(ctx, res)
+	if err != nil {
+		res.Body.Close()
+		cancel()
+		return nil, errors.Wrapf(err, "failed to read %q", key)
+	}
+
+	return &contentReader{
+		b:        b,
+		ctx:      ctx,
+		cancel:   cancel,
+		res:      res,
+		content:  content,
+		key:      key,
+		expected: hash,
+		hash:     sha1.New(),
+	}, nil
+}
+
+// GetBytes returns the content of the file for file, a .sha1 file or with
+// -lock-file, the file itself. The content is held in memory; see
+// GetReader for large content.
+func (b *s3Bin) GetBytes(file string) ([]byte, error) {
+	r, err := b.GetReader(file)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return ioutil.ReadAll(r)
+}
+
+// GetStdout writes the content of the file for file to stdout.
+func (b *s3Bin) GetStdout(file string) error {
+	r, err := b.GetReader(file)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	_, err = io.Copy(os.Stdout, r)
+	return err
+}
+
+// contentReader is the reader returned by GetReader.
+type contentReader struct {
+	b        *s3Bin
+	ctx      context.Context
+	cancel   context.CancelFunc
+	res      *s3.GetObjectOutput
+	content  *objectContent
+	key      string
+	expected string
+	hash     hash.Hash
+	n        int64
+	err      error
+}
+
+func (r *contentReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+
+	n, err := r.content.data.Read(p)
+	r.hash.Write(p[:n])
+	r.n += int64(n)
+
+	if err == io.EOF {
+		err = r.check()
+		if err == nil {
+			err = io.EOF
+			atomic.AddInt64(&r.b.stats.FilesDownloaded, 1)
+		}
+	} else if err != nil {
+		if r.ctx.Err() == context.DeadlineExceeded {
+			err = errors.Wrapf(errObjectTimeout, "failed to download %q after %v",
+				r.key, r.b.perObjectTimeout)
+		} else {
+			err = errors.Wrapf(err, "failed to download %q", r.key)
+		}
+	}
+
+	r.err = err
+	return n, err
+}
+
+// check checks the content once it has been read to the end.
+func (r *contentReader) check() error {
+	err := r.content.checkSize(r.n)
+	if err == nil {
+		err = r.content.finish()
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to download %q", r.key)
+	}
+
+	actual := hex.EncodeToString(r.hash.Sum(nil))
+	if actual != r.expected {
+		return errors.Wrapf(ErrHashMismatch, "object %q has hash %s, expected %s",
+			r.key, actual, r.expected)
+	}
+	return nil
+}
+
+func (r *contentReader) Close() error {
+	err := r.res.Body.Close()
+	r.cancel()
+	return err
+}
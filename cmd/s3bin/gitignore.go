@@ -0,0 +1,169 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ignoreFile adds file to the nearest .gitignore, so that the binary stays
+// out of git while its .sha1 file is committed. The nearest .gitignore is
+// the first one found from file's directory up to the root of its git
+// repository. If there is none, one is created in file's directory.
+//
+// The entry is anchored to the .gitignore's directory, so it matches file
+// and nothing else; in particular, not the .sha1 file. Entries that would
+// ignore the .sha1 file itself are removed. Adding a file that is already
+// in the .gitignore changes nothing.
+func ignoreFile(file string) error {
+	absFile, err := filepath.Abs(file)
+	if err != nil {
+		return errors.Wrapf(err, "failed to resolve %q", file)
+	}
+
+	ignorePath, err := nearestGitignore(filepath.Dir(absFile))
+	if err != nil {
+		return err
+	}
+
+	rel, err := filepath.Rel(filepath.Dir(ignorePath), absFile)
+	if err != nil {
+		return errors.Wrapf(err, "failed to resolve %q", file)
+	}
+	if strings.ContainsAny(rel, "\r\n") {
+		return errors.Errorf("%q cannot be added to a .gitignore", file)
+	}
+	rel = filepath.ToSlash(rel)
+
+	mode := os.FileMode(0644)
+	data, err := ioutil.ReadFile(ignorePath)
+	if err == nil {
+		fstat, err := os.Stat(ignorePath)
+		if err != nil {
+			return errors.Wrapf(err, "failed to read attributes of %q", ignorePath)
+		}
+		mode = fstat.Mode().Perm()
+	} else if !os.IsNotExist(err) {
+		return errors.Wrapf(err, "failed to read %q", ignorePath)
+	}
+
+	entry := "/" + escapeIgnorePattern(rel)
+	sidecarEntry := entry + ".sha1"
+	matches := func(line, pattern string) bool {
+		// A pattern with a slash other than at its end is anchored, whether
+		// or not it starts with a slash.
+		line = strings.TrimRight(line, "\r")
+		return line == pattern ||
+			(strings.Contains(rel, "/") && "/"+line == pattern)
+	}
+
+	var lines []string
+	if len(data) > 0 {
+		lines = strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	}
+
+	found := false
+	changed := false
+	kept := lines[:0]
+	for _, line := range lines {
+		if matches(line, sidecarEntry) {
+			changed = true
+			continue
+		}
+		if matches(line, entry) {
+			found = true
+		}
+		kept = append(kept, line)
+	}
+	if !found {
+		kept = append(kept, entry)
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+
+	newData := []byte(strings.Join(kept, "\n") + "\n")
+	return writeFileAtomic(ignorePath, newData, mode)
+}
+
+// nearestGitignore returns the path of the .gitignore that ignoreFile adds
+// the files in dir to.
+func nearestGitignore(dir string) (string, error) {
+	for d := dir; ; {
+		candidate := filepath.Join(d, ".gitignore")
+		_, err := os.Stat(candidate)
+		if err == nil {
+			return candidate, nil
+		} else if !os.IsNotExist(err) {
+			return "", errors.Wrapf(err, "failed to read attributes of %q", candidate)
+		}
+
+		// The root of the repository is the last place to look in.
+		_, err = os.Stat(filepath.Join(d, ".git"))
+		if err == nil {
+			break
+		}
+
+		parent := filepath.Dir(d)
+		if parent == d {
+			break
+		}
+		d = parent
+	}
+
+	return filepath.Join(dir, ".gitignore"), nil
+}
+
+// escapeIgnorePattern escapes the characters of a path that have a special
+// meaning in .gitignore patterns. A leading # or ! needs no escaping, since
+// entries start with a slash.
+func escapeIgnorePattern(path string) string {
+	var sb strings.Builder
+	for _, c := range path {
+		switch c {
+		case '*', '?', '[', '\\':
+			sb.WriteByte('\\')
+		}
+		sb.WriteRune(c)
+	}
+
+	// Trailing spaces are ignored unless escaped.
+	escaped := sb.String()
+	trimmed := strings.TrimRight(escaped, " ")
+	return trimmed + strings.Repeat("\\ ", len(escaped)-len(trimmed))
+}
+
+// writeFileAtomic replaces path with data, through a temporary file that is
+// renamed over it, so that readers never observe a partially written file.
+func writeFileAtomic(path string, data []byte, mode os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".s3bin-")
+	if err != nil {
+		return errors.Wrapf(err, "failed to create temporary file for %q", path)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to write temporary file for %q", path)
+	}
+
+	err = os.Chmod(tmp.Name(), mode)
+	if err != nil {
+		return errors.Wrapf(err, "failed to set mode of %q", path)
+	}
+
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return errors.Wrapf(err, "failed to replace %q", path)
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/pkg/errors"
+)
+
+// Metadata keys of gzip objects, which do not have a header member.
+const (
+	// headerMetadata is the base64 encoded JSON header.
+	headerMetadata = "s3bin-header"
+
+	// modeMetadata is the file mode, in octal.
+	modeMetadata = "s3bin-mode"
+
+	// sizeMetadata is the size of the uncompressed content.
+	sizeMetadata = "s3bin-size"
+)
+
+// maxHeaderMetadata is the largest encoded header stored in metadata. S3
+// allows 2 KiB of user metadata in total.
+const maxHeaderMetadata = 1536
+
+// errHeaderTooLarge is returned by packGzip for headers larger than
+// maxHeaderMetadata.
+var errHeaderTooLarge = errors.New("header is too large to store in object metadata")
+
+// packGzip returns the body and metadata of a gzip object for size bytes of
+// content read from r.
+func packGzip(header *Header, r io.Reader, size int64, mode os.FileMode, bufSize int) (map[string]*string, io.ReadSeeker, error) {
+	return packGzipLevel(header, r, size, mode, bufSize, gzip.DefaultCompression)
+}
+
+// packGzipLevel is packGzip at the given gzip compression level.
+func packGzipLevel(header *Header, r io.Reader, size int64, mode os.FileMode, bufSize, level int) (map[string]*string, io.ReadSeeker, error) {
+	headerBytes, err := json.Marshal(header)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "json.Marshal(header)")
+	}
+
+	encodedHeader := base64.StdEncoding.EncodeToString(headerBytes)
+	if len(encodedHeader) > maxHeaderMetadata {
+		return nil, nil, errors.Wrapf(errHeaderTooLarge, "failed to pack header of %d bytes", len(encodedHeader))
+	}
+
+	gzippedBuf := &bytes.Buffer{}
+	gzipWriter, err := newGzipWriter(gzippedBuf, level)
+	if err != nil {
+		return nil, nil, err
+	}
+	_, err = copyBuffer(gzipWriter, r, bufSize)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to read file")
+	}
+	err = gzipWriter.Close()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to compress file")
+	}
+
+	metadata := formatOnly(formatGzip)
+	metadata[headerMetadata] = aws.String(encodedHeader)
+	metadata[modeMetadata] = aws.String(strconv.FormatUint(uint64(mode), 8))
+	metadata[sizeMetadata] = aws.String(strconv.FormatInt(size, 10))
+	return metadata, bytes.NewReader(gzippedBuf.Bytes()), nil
+}
+
+// openGzip opens the content of a gzip object with the given metadata,
+// whose body is read from r.
+func (b *s3Bin) openGzip(metadata map[string]*string, r io.Reader) (*objectContent, error) {
+	headerBytes, err := base64.StdEncoding.DecodeString(
+		metadataValue(metadata, headerMetadata))
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid %s metadata", headerMetadata)
+	}
+
+	header := &Header{}
+	if b.strictFormat {
+		err = decodeStrict(bytes.NewReader(headerBytes), header)
+	} else {
+		err = json.Unmarshal(headerBytes, header)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid %s metadata", headerMetadata)
+	}
+
+	if header.Version != version {
+		return nil, errors.Errorf("unsupported version %d", header.Version)
+	}
+
+	mode, err := strconv.ParseUint(metadataValue(metadata, modeMetadata), 8, 32)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid %s metadata", modeMetadata)
+	}
+
+	size, err := strconv.ParseInt(metadataValue(metadata, sizeMetadata), 10, 64)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid %s metadata", sizeMetadata)
+	}
+
+	gzipReader, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create gzip reader")
+	}
+
+	if b.strictFormat {
+		gzipReader.Multistream(false)
+	}
+
+	return &objectContent{
+		format:  formatGzip,
+		header:  header,
+		mode:    os.FileMode(mode),
+		hasMode: true,
+		size:    size,
+		data:    gzipReader,
+		strict:  b.strictFormat,
+		stream:  gzipReader,
+		body:    r,
+	}, nil
+}
+
+// gzipOS is the OS byte of the gzip streams written by s3bin: unknown.
+const gzipOS = 255
+
+// newGzipWriter returns a gzip writer whose output depends only on its
+// input and level. The gzip header is fixed, with no modification time or
+// name, and the same OS byte everywhere, so that the same content is always
+// stored in the same bytes. This keeps ETags comparable, and lets
+// -resumable-uploads resume uploads of objects packed again.
+func newGzipWriter(w io.Writer, level int) (*gzip.Writer, error) {
+	gzipWriter, err := gzip.NewWriterLevel(w, level)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create gzip writer")
+	}
+
+	gzipWriter.Header = gzip.Header{OS: gzipOS}
+	return gzipWriter, nil
+}
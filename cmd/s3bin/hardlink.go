@@ -0,0 +1,70 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// linkDuplicate makes targetFile a hard link to srcFile, a file with the
+// same content restored earlier by GetDir, instead of downloading it again.
+// Where hard links are not supported, e.g. across file systems, srcFile is
+// copied instead. Either way, targetFile is replaced atomically.
+//
+// Linked files share their content, mode and extended attributes: changing
+// one of them changes them all.
+func linkDuplicate(srcFile, targetFile string) error {
+	tmp := targetFile + ".s3bin-link"
+	os.Remove(tmp)
+
+	err := os.Link(srcFile, tmp)
+	if err != nil {
+		log.Printf("Failed to link %q to %q, copying it instead: %v", targetFile, srcFile, err)
+		err = copyFile(srcFile, tmp)
+		if err != nil {
+			os.Remove(tmp)
+			return err
+		}
+	}
+
+	err = os.Rename(tmp, targetFile)
+	if err != nil {
+		os.Remove(tmp)
+		return errors.Wrapf(err, "failed to replace %q", targetFile)
+	}
+	return nil
+}
+
+// copyFile copies the content and mode of srcFile to a new file at dstFile.
+func copyFile(srcFile, dstFile string) error {
+	src, err := os.Open(srcFile)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open %q", srcFile)
+	}
+	defer src.Close()
+
+	info, err := src.Stat()
+	if err != nil {
+		return errors.Wrapf(err, "failed to read attributes of %q", srcFile)
+	}
+
+	dst, err := os.OpenFile(dstFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return errors.Wrapf(err, "failed to create %q", dstFile)
+	}
+
+	_, err = io.Copy(dst, src)
+	if err == nil {
+		// The mode given to OpenFile is subject to the umask.
+		err = dst.Chmod(info.Mode().Perm())
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to copy %q to %q", srcFile, dstFile)
+	}
+	return nil
+}
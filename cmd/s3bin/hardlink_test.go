@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// fakeObjects serves the raw objects it holds, by path-style URL path, to
+// GetObject requests.
+type fakeObjects map[string][]byte
+
+func (o fakeObjects) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	data, ok := o[r.URL.Path]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("<Error><Code>NoSuchKey</Code></Error>"))
+		return
+	}
+	w.Header().Set("x-amz-meta-"+formatMetadata, formatRaw)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+}
+
+// newTestS3Bin returns an s3Bin for bucket "bk" of the S3 server at url.
+func newTestS3Bin(t *testing.T, url string) *s3Bin {
+	sess, err := session.NewSession(&aws.Config{
+		Region:           aws.String("us-west-2"),
+		Endpoint:         aws.String(url),
+		S3ForcePathStyle: aws.Bool(true),
+		Credentials:      credentials.NewStaticCredentials("id", "secret", ""),
+	})
+	if err != nil {
+		t.Fatalf("session.NewSession: %v", err)
+	}
+
+	b := &s3Bin{
+		s3Bucket:    "bk",
+		sess:        sess,
+		hashWorkers: 1,
+		concurrency: 1,
+	}
+	b.setRegion("us-west-2")
+	err = b.useKeyLayout(nil)
+	if err != nil {
+		t.Fatalf("useKeyLayout: %v", err)
+	}
+	return b
+}
+
+func hashOf(data []byte) string {
+	sum := sha1.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func writeTestFile(t *testing.T, path string, data []byte) {
+	err := ioutil.WriteFile(path, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestGetDirBreaksHardLinks checks that updating a file linked by
+// -hardlink-dedup to another one does not change the other one.
+func TestGetDirBreaksHardLinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3bin-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldContent, newContent := []byte("old content\n"), []byte("new content\n")
+	oldHash, newHash := hashOf(oldContent), hashOf(newContent)
+
+	objects := fakeObjects{}
+	srv := httptest.NewServer(objects)
+	defer srv.Close()
+
+	b := newTestS3Bin(t, srv.URL)
+	b.hardlinkDedup = true
+	for hash, content := range map[string][]byte{oldHash: oldContent, newHash: newContent} {
+		key, err := b.objectKey(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		objects["/bk/"+key] = content
+	}
+
+	// A and B were linked by an earlier run, and B's .sha1 file changed
+	// since.
+	fileA, fileB := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+	writeTestFile(t, fileA, oldContent)
+	err = os.Link(fileA, fileB)
+	if err != nil {
+		t.Skipf("hard links are not supported: %v", err)
+	}
+	writeTestFile(t, fileA+".sha1", []byte(oldHash+"\n"))
+	writeTestFile(t, fileB+".sha1", []byte(newHash+"\n"))
+
+	err = b.GetDir(dir)
+	if err != nil {
+		t.Fatalf("GetDir: %v", err)
+	}
+
+	hashA, err := calcSha1(fileA, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hashA != oldHash {
+		t.Errorf("%q has hash %s, want its old hash %s", fileA, hashA, oldHash)
+	}
+
+	hashB, err := calcSha1(fileB, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hashB != newHash {
+		t.Errorf("%q has hash %s, want %s", fileB, hashB, newHash)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// countRequestBody is a Send handler that counts the bytes of the request
+// body sent in b.transferred.
+func (b *s3Bin) countRequestBody(r *request.Request) {
+	if r.HTTPRequest.Body != nil && r.HTTPRequest.Body != http.NoBody {
+		r.HTTPRequest.Body = &countingReadCloser{
+			ReadCloser: r.HTTPRequest.Body,
+			n:          &b.transferred,
+		}
+	}
+}
+
+// countResponseBody is a Send handler that counts the bytes of the response
+// body received in b.transferred.
+func (b *s3Bin) countResponseBody(r *request.Request) {
+	if r.HTTPResponse != nil && r.HTTPResponse.Body != nil {
+		r.HTTPResponse.Body = &countingReadCloser{
+			ReadCloser: r.HTTPResponse.Body,
+			n:          &b.transferred,
+		}
+	}
+}
+
+// heartbeat logs that the transfer of name is still going, and how many
+// bytes it has transferred, every -heartbeat interval until the returned
+// function is called.
+func (b *s3Bin) heartbeat(name string) func() {
+	if b.heartbeatInterval <= 0 {
+		return func() {}
+	}
+
+	start := atomic.LoadInt64(&b.transferred)
+	ticker := time.NewTicker(b.heartbeatInterval)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				log.Printf("Still transferring %q, %d bytes so far",
+					name, atomic.LoadInt64(&b.transferred)-start)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		ticker.Stop()
+		close(done)
+	}
+}
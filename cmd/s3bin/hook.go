@@ -0,0 +1,32 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// runDownloadHook runs the -on-download command, if any, for a file that
+// was just downloaded. The command is split into arguments on whitespace,
+// and is not run through a shell; targetFile is added as its last argument.
+// Its output goes to stderr, so that it does not mix with s3bin's own
+// output.
+func (b *s3Bin) runDownloadHook(targetFile string) error {
+	if b.onDownload == "" {
+		return nil
+	}
+
+	args := strings.Fields(b.onDownload)
+	cmd := exec.Command(args[0], append(args[1:], targetFile)...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+
+	err := cmd.Run()
+	if err != nil {
+		return errors.Wrapf(err, "-on-download command %q failed for %q",
+			b.onDownload, targetFile)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+)
+
+// Import adopts the object at key, uploaded by other means, into the
+// scheme of s3bin. The object is downloaded to outFile as-is, taken to be
+// the file's content, and hashed. It is then copied server-side to the key
+// for its hash, stored raw, and outFile's hash is recorded as with Put.
+// Objects whose content is already stored are not copied again. The object
+// at key is left in place.
+func (b *s3Bin) Import(key, outFile string) error {
+	ctx, cancel := b.objectContext()
+	defer cancel()
+
+	res, err := b.getObject(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	tmp, err := ioutil.TempFile(filepath.Dir(outFile), ".s3bin-")
+	if err != nil {
+		return errors.Wrapf(err, "failed to create temporary file for %q", outFile)
+	}
+	defer os.Remove(tmp.Name())
+
+	h := sha1.New()
+	size, err := io.Copy(io.MultiWriter(tmp, h), res.Body)
+	if err == nil {
+		err = tmp.Chmod(rawMode)
+	}
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to download %q", key)
+	}
+	if res.ContentLength != nil && size != *res.ContentLength {
+		return errors.Errorf("%q is truncated: read %d of %d bytes",
+			key, size, *res.ContentLength)
+	}
+
+	err = os.Rename(tmp.Name(), outFile)
+	if err != nil {
+		return errors.Wrapf(err, "failed to replace %q", outFile)
+	}
+	atomic.AddInt64(&b.stats.FilesDownloaded, 1)
+
+	hash := hex.EncodeToString(h.Sum(nil))
+	dstKey, err := b.objectKey(hash)
+	if err != nil {
+		return err
+	}
+	exists, err := b.keyExists(dstKey)
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		log.Printf("%q is already stored as %q", key, dstKey)
+	} else {
+		err = b.copyRaw(key, dstKey, hash, size)
+		if err != nil {
+			return err
+		}
+		log.Printf("Imported %q as %q", key, dstKey)
+	}
+
+	return b.recordHash(outFile, hash, size)
+}
+
+// copyRaw copies the object at srcKey, whose content has the given hash and
+// size, to dstKey, with the metadata of a raw object.
+func (b *s3Bin) copyRaw(srcKey, dstKey, hash string, size int64) error {
+	metadata := formatOnly(formatRaw)
+	metadata[hashMetadata] = aws.String(hash)
+	return b.copyKey(srcKey, dstKey, metadata, size, b.quota)
+}
+
+// copyKey copies the object at srcKey, of size bytes, to dstKey, with
+// metadata, or if nil, the source's. The copy is made with the storage
+// class, ACL and object lock settings of uploads, and counts towards q.
+func (b *s3Bin) copyKey(srcKey, dstKey string, metadata map[string]*string, size int64, q *prefixQuota) error {
+	input := &s3.CopyObjectInput{
+		Bucket:       aws.String(b.s3Bucket),
+		Key:          aws.String(dstKey),
+		CopySource:   aws.String(copySource(b.s3Bucket, srcKey)),
+		StorageClass: b.storageClass(size),
+		ACL:          b.acl,
+		RequestPayer: b.requestPayer,
+	}
+
+	if metadata != nil {
+		input.MetadataDirective = aws.String(s3.MetadataDirectiveReplace)
+		input.Metadata = metadata
+	}
+	if b.s3Checksum != "" {
+		input.ChecksumAlgorithm = aws.String(b.s3Checksum)
+	}
+	if b.objectLockMode != nil {
+		input.ObjectLockMode = b.objectLockMode
+		input.ObjectLockRetainUntilDate = b.objectLockUntil
+	}
+
+	err := b.checkQuota(q, dstKey, size)
+	if err != nil {
+		return err
+	}
+
+	_, err = b.s3Cli.CopyObject(input)
+	if err != nil {
+		return errors.Wrapf(b.explainLocked(dstKey, err),
+			"failed to copy %q to %q in S3 bucket %q", srcKey, dstKey, b.s3Bucket)
+	}
+
+	b.addUsage(q, size)
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// inflightLimit is a semaphore weighted by bytes, which caps the combined
+// size of the objects Mirror copies at once with -max-inflight-bytes. A
+// copy waits until its object fits under the cap; an object larger than
+// the cap waits until it is the only one.
+type inflightLimit struct {
+	mu       sync.Mutex
+	capacity int64
+	used     int64
+
+	// released is closed, and replaced, whenever bytes are released.
+	released chan struct{}
+}
+
+func newInflightLimit(capacity int64) *inflightLimit {
+	return &inflightLimit{
+		capacity: capacity,
+		released: make(chan struct{}),
+	}
+}
+
+// acquire takes n bytes, blocking until they fit or ctx is done. It returns
+// the number of bytes taken, to be given to release. A nil inflightLimit
+// takes nothing.
+func (l *inflightLimit) acquire(ctx context.Context, n int64) (int64, error) {
+	if l == nil {
+		return 0, nil
+	}
+	if n > l.capacity {
+		n = l.capacity
+	}
+
+	for {
+		l.mu.Lock()
+		if l.used+n <= l.capacity {
+			l.used += n
+			l.mu.Unlock()
+			return n, nil
+		}
+		released := l.released
+		l.mu.Unlock()
+
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+}
+
+// release returns n bytes taken by acquire.
+func (l *inflightLimit) release(n int64) {
+	if l == nil || n == 0 {
+		return
+	}
+
+	l.mu.Lock()
+	l.used -= n
+	close(l.released)
+	l.released = make(chan struct{})
+	l.mu.Unlock()
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+	"text/template/parse"
+
+	"github.com/pkg/errors"
+)
+
+// With -key-template, the keys of objects are derived from their hashes by
+// a Go text/template instead of by storeKey. The template is recorded in
+// the key layout of the prefix, where readers find it before they look up
+// any object: the header is stored within the object, so it cannot say
+// where the object is. Since readers only know the hash of the file they
+// want, the template can only use the hash.
+
+// defaultKeyTemplate is the key template equivalent to storeKey with the
+// default layout.
+const defaultKeyTemplate = "{{.Hash4}}/{{slice .Hash 4 8}}/{{slice .Hash 8 12}}/{{slice .Hash 12 16}}/{{slice .Hash 16 20}}"
+
+// keyTemplateData is the data key templates are executed with.
+type keyTemplateData struct {
+	// Hash is the hash of the object, in hex.
+	Hash string
+	// Hash4 is the first 4 hex digits of the hash.
+	Hash4 string
+}
+
+// parseKeyTemplate parses a key template, and checks that it gives valid
+// keys, and different keys for hashes that differ in any of their first
+// storeKeyDigits digits.
+func parseKeyTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("key").Parse(text)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid key template %q", text)
+	}
+
+	if len(tmpl.Templates()) > 1 {
+		return nil, errors.Errorf("key template %q defines templates, which is not supported", text)
+	}
+	if tmpl.Tree != nil {
+		err = checkKeyTemplateNode(tmpl.Tree.Root)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid key template %q", text)
+		}
+	}
+
+	base := strings.Repeat("0", 40)
+	baseKey, err := executeKeyTemplate(tmpl, base)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < storeKeyDigits; i++ {
+		key, err := executeKeyTemplate(tmpl, base[:i]+"1"+base[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		if key == baseKey {
+			return nil, errors.Errorf(
+				"key template %q does not use digit %d of the hash, so keys of different content would collide",
+				text, i+1)
+		}
+	}
+
+	return tmpl, nil
+}
+
+// checkKeyTemplateNode returns an error if node, of a key template, uses
+// anything but text and pipelines of .Hash, .Hash4, constants, slice and
+// printf. Such a template gives keys of the same shape for every hash: if
+// it executes for one hash, it does for all of them. Actions like if, or
+// functions like eq and index, would let it fail for some hashes only.
+func checkKeyTemplateNode(node parse.Node) error {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		for _, child := range n.Nodes {
+			err := checkKeyTemplateNode(child)
+			if err != nil {
+				return err
+			}
+		}
+	case *parse.ActionNode:
+		return checkKeyTemplateNode(n.Pipe)
+	case *parse.PipeNode:
+		if len(n.Decl) > 0 {
+			return errors.Errorf("variables are not supported in %q", n.String())
+		}
+		for _, cmd := range n.Cmds {
+			err := checkKeyTemplateNode(cmd)
+			if err != nil {
+				return err
+			}
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			err := checkKeyTemplateNode(arg)
+			if err != nil {
+				return err
+			}
+		}
+	case *parse.IdentifierNode:
+		if n.Ident != "slice" && n.Ident != "printf" {
+			return errors.Errorf("function %q is not supported (only slice and printf are)", n.Ident)
+		}
+	case *parse.TextNode, *parse.FieldNode, *parse.StringNode, *parse.NumberNode:
+	default:
+		return errors.Errorf("%q is not supported (only .Hash, .Hash4, slice and printf are)",
+			node.String())
+	}
+	return nil
+}
+
+// executeKeyTemplate returns the key given by tmpl for hash, relative to
+// the prefix.
+func executeKeyTemplate(tmpl *template.Template, hash string) (string, error) {
+	var buf strings.Builder
+	err := tmpl.Execute(&buf, &keyTemplateData{
+		Hash:  hash,
+		Hash4: hash[:4],
+	})
+	if err != nil {
+		return "", errors.Wrap(err,
+			"failed to execute key template (only .Hash and .Hash4 are available)")
+	}
+
+	key := buf.String()
+	if key == "" || strings.HasPrefix(key, "/") || strings.HasSuffix(key, "/") ||
+		strings.Contains(key, "//") {
+		return "", errors.Errorf("key template gives invalid key %q", key)
+	}
+	return key, nil
+}
+
+// relativeKey returns the key of the object for hash, relative to the
+// prefix, according to the prefix's key layout.
+func (b *s3Bin) relativeKey(hash string) (string, error) {
+	err := b.loadKeyLayout()
+	if err != nil {
+		return "", err
+	}
+
+	if b.keyTemplate == nil {
+		return storeKey(hash, b.keyPrefixBytes), nil
+	}
+	return executeKeyTemplate(b.keyTemplate, hash)
+}
+
+// currentLayout returns the key layout in use, or nil for the default
+// layout. The layout must have been loaded by loadKeyLayout.
+func (b *s3Bin) currentLayout() *keyLayout {
+	if b.keyTemplate != nil {
+		return &keyLayout{
+			Version:     keyTemplateLayoutVersion,
+			KeyTemplate: b.keyTemplateText,
+		}
+	}
+	if b.keyPrefixBytes != defaultKeyPrefixBytes {
+		return &keyLayout{
+			Version:        keyLayoutVersion,
+			KeyPrefixBytes: b.keyPrefixBytes,
+		}
+	}
+	return nil
+}
+
+// describeLayout returns the options that select layout, for messages.
+func describeLayout(layout *keyLayout) string {
+	switch {
+	case layout == nil:
+		return "the default key layout"
+	case layout.KeyTemplate != "":
+		return fmt.Sprintf("-key-template %q", layout.KeyTemplate)
+	default:
+		return fmt.Sprintf("-key-prefix-bytes %d", layout.KeyPrefixBytes)
+	}
+}
+
+// sameLayout returns whether layouts a and b, either of which may be nil
+// for the default layout, give the same keys.
+func sameLayout(a, b *keyLayout) bool {
+	normalize := func(layout *keyLayout) keyLayout {
+		if layout == nil {
+			return keyLayout{KeyPrefixBytes: defaultKeyPrefixBytes}
+		}
+		if layout.KeyTemplate != "" {
+			return keyLayout{KeyTemplate: layout.KeyTemplate}
+		}
+		return keyLayout{KeyPrefixBytes: layout.KeyPrefixBytes}
+	}
+	return normalize(a) == normalize(b)
+}
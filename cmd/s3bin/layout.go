@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+)
+
+// The key layout of a prefix records how the keys of its objects are
+// derived from their hashes. Prefixes without a layout object use the
+// default layout.
+const (
+	layoutObject          = "s3bin-layout.json"
+	keyLayoutVersion      = 1
+	defaultKeyPrefixBytes = 4
+
+	// keyTemplateLayoutVersion is the version of layouts with a key
+	// template, which versions of s3bin without -key-template must refuse.
+	keyTemplateLayoutVersion = 2
+
+	// storeKeyDigits is the number of hex digits of the hash in object
+	// keys.
+	storeKeyDigits = 20
+)
+
+// layoutCacheTTL is how long -cache-dir caches that a prefix has no key
+// layout.
+const layoutCacheTTL = 10 * time.Minute
+
+// keyLayout is the content of a layout object.
+type keyLayout struct {
+	Version        int    `json:"version"`
+	KeyPrefixBytes int    `json:"key_prefix_bytes,omitempty"`
+	KeyTemplate    string `json:"key_template,omitempty"`
+}
+
+// layoutKey returns the key of the layout object of prefix.
+func layoutKey(prefix string) string {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return layoutObject
+	}
+	return prefix + "/" + layoutObject
+}
+
+// readKeyLayout returns the key layout stored for prefix, or nil if the
+// prefix has none. Without permission to list the bucket, S3 denies access
+// to missing objects rather than report them as not found, so a layout
+// object that cannot be read is taken as missing too, with a warning: a
+// role limited to reading and writing objects can then use the default
+// layout.
+func (b *s3Bin) readKeyLayout(prefix string) (*keyLayout, error) {
+	key := layoutKey(prefix)
+	res, err := b.getObject(context.Background(), key)
+	if errors.Cause(err) == ErrObjectNotFound {
+		return nil, nil
+	} else if isAccessDenied(err) {
+		log.Printf("Warning: access to key layout %q is denied; using the default layout", key)
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %q", key)
+	}
+
+	layout := &keyLayout{}
+	err = json.Unmarshal(data, layout)
+	if err != nil {
+		return nil, errors.Wrapf(err, "key layout %q is invalid", key)
+	}
+
+	switch layout.Version {
+	case keyLayoutVersion:
+		if !isValidKeyPrefixBytes(layout.KeyPrefixBytes) {
+			return nil, errors.Errorf("key layout %q has invalid key_prefix_bytes %d",
+				key, layout.KeyPrefixBytes)
+		}
+	case keyTemplateLayoutVersion:
+		_, err = parseKeyTemplate(layout.KeyTemplate)
+		if err != nil {
+			return nil, errors.Wrapf(err, "key layout %q has invalid key_template", key)
+		}
+	default:
+		return nil, errors.Errorf("key layout %q has unsupported version %d",
+			key, layout.Version)
+	}
+
+	return layout, nil
+}
+
+// writeKeyLayout stores the key layout of prefix. It refuses to do so if
+// the prefix already has objects, since they would no longer be found.
+// S3 cannot list and write atomically, so the layout is read back once
+// stored: if another process stored a different layout meanwhile, it
+// fails rather than use a layout that is not the prefix's. Objects put
+// with the default layout between the list and the write are not
+// detected.
+func (b *s3Bin) writeKeyLayout(prefix string, layout *keyLayout) error {
+	listPrefix := strings.Trim(prefix, "/")
+	if listPrefix != "" {
+		listPrefix += "/"
+	}
+
+	list, err := b.s3Cli.ListObjectsV2(&s3.ListObjectsV2Input{
+		Bucket:       aws.String(b.s3Bucket),
+		Prefix:       aws.String(listPrefix),
+		MaxKeys:      aws.Int64(1),
+		RequestPayer: b.requestPayer,
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to list objects in S3 bucket %q", b.s3Bucket)
+	}
+	if len(list.Contents) > 0 {
+		return errors.Errorf(
+			"cannot change the key layout of prefix %q, which already has objects",
+			prefix)
+	}
+
+	data, err := json.Marshal(layout)
+	if err != nil {
+		return errors.Wrap(err, "json.Marshal(layout)")
+	}
+
+	key := layoutKey(prefix)
+	_, err = b.s3Cli.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(b.s3Bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(data),
+		ACL:    b.acl,
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to write key layout %q", key)
+	}
+
+	stored, err := b.readKeyLayout(prefix)
+	if err != nil {
+		return err
+	}
+	if stored != nil && !sameLayout(stored, layout) {
+		return errors.Errorf("key layout %q was concurrently changed to %s",
+			key, describeLayout(stored))
+	}
+
+	if b.cacheDir != "" {
+		// The prefix may be cached as having no layout.
+		os.Remove(b.layoutCachePath(prefix))
+	}
+
+	log.Printf("Created key layout %q", key)
+	return nil
+}
+
+// setupKeyLayout sets the key layout from the one stored for the prefix.
+// requested is the -key-prefix-bytes value, or 0 if it was not given, and
+// requestedTemplate the -key-template value, or empty; they must match the
+// stored layout. If the prefix has no layout, the requested one is used,
+// and if write is set and it is not the default, stored. If neither is
+// given, the stored layout is left for loadKeyLayout to read.
+func (b *s3Bin) setupKeyLayout(requested int, requestedTemplate string, write bool) error {
+	if requested != 0 && !isValidKeyPrefixBytes(requested) {
+		return errors.Errorf("-key-prefix-bytes must be between 1 and %d",
+			storeKeyDigits)
+	}
+	if requested != 0 && requestedTemplate != "" {
+		return errors.New("-key-prefix-bytes is not supported with -key-template")
+	}
+
+	var want *keyLayout
+	switch {
+	case requestedTemplate != "" && requestedTemplate != defaultKeyTemplate:
+		_, err := parseKeyTemplate(requestedTemplate)
+		if err != nil {
+			return err
+		}
+		want = &keyLayout{
+			Version:     keyTemplateLayoutVersion,
+			KeyTemplate: requestedTemplate,
+		}
+	case requested != 0 && requested != defaultKeyPrefixBytes:
+		want = &keyLayout{
+			Version:        keyLayoutVersion,
+			KeyPrefixBytes: requested,
+		}
+	}
+
+	if requested == 0 && requestedTemplate == "" {
+		// Without layout options, the layout is only read once a key is
+		// needed; see loadKeyLayout.
+		return nil
+	}
+
+	// The layout is set up here, rather than by loadKeyLayout.
+	b.layoutOnce.Do(func() {})
+
+	layout, err := b.readKeyLayout(b.prefix)
+	if err != nil {
+		return err
+	}
+
+	if layout != nil {
+		if !sameLayout(layout, want) {
+			return errors.Errorf("prefix %q uses %s, not %s",
+				b.prefix, describeLayout(layout), describeLayout(want))
+		}
+		return b.useKeyLayout(layout)
+	}
+
+	if want != nil && write {
+		err = b.writeKeyLayout(b.prefix, want)
+		if err != nil {
+			return err
+		}
+	}
+
+	return b.useKeyLayout(want)
+}
+
+// loadKeyLayout makes the key layout stored for the prefix the one in use,
+// the first time it is called, unless setupKeyLayout already set one up.
+// Keys are derived only once it returns, so that modes that derive none do
+// not read the layout.
+func (b *s3Bin) loadKeyLayout() error {
+	b.layoutOnce.Do(func() {
+		layout, err := b.cachedKeyLayout(b.prefix)
+		if err == nil {
+			err = b.useKeyLayout(layout)
+		}
+		b.layoutErr = err
+	})
+	return b.layoutErr
+}
+
+// cachedLayout is the key layout of a prefix cached in -cache-dir. Layout
+// is nil if the prefix had none.
+type cachedLayout struct {
+	Bucket string     `json:"bucket"`
+	Key    string     `json:"key"`
+	Layout *keyLayout `json:"layout"`
+	Time   time.Time  `json:"time"`
+}
+
+// cachedKeyLayout is readKeyLayout, cached in -cache-dir if it is set. The
+// layout of a prefix cannot change once it has objects, so a cached layout
+// is used however old it is. That a prefix has no layout is only cached for
+// layoutCacheTTL, since one may be created for it until it has objects.
+func (b *s3Bin) cachedKeyLayout(prefix string) (*keyLayout, error) {
+	if b.cacheDir == "" {
+		return b.readKeyLayout(prefix)
+	}
+
+	key := layoutKey(prefix)
+	path := b.layoutCachePath(prefix)
+
+	cached := &cachedLayout{}
+	data, err := ioutil.ReadFile(path)
+	if err == nil && json.Unmarshal(data, cached) == nil &&
+		cached.Bucket == b.s3Bucket && cached.Key == key &&
+		(cached.Layout != nil || time.Since(cached.Time) < layoutCacheTTL) {
+		return cached.Layout, nil
+	}
+
+	layout, err := b.readKeyLayout(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err = json.Marshal(&cachedLayout{
+		Bucket: b.s3Bucket,
+		Key:    key,
+		Layout: layout,
+		Time:   time.Now(),
+	})
+	if err == nil {
+		// Failing to cache the layout only makes the next run read it again.
+		writeFileAtomic(path, data, 0644)
+	}
+	return layout, nil
+}
+
+// layoutCachePath returns the path of the key layout of prefix cached in
+// -cache-dir.
+func (b *s3Bin) layoutCachePath(prefix string) string {
+	id := sha1.Sum([]byte(b.s3Bucket + "/" + layoutKey(prefix)))
+	return filepath.Join(b.cacheDir, "layout-"+hex.EncodeToString(id[:]))
+}
+
+// useKeyLayout makes layout, or the default layout if nil, the one in use.
+func (b *s3Bin) useKeyLayout(layout *keyLayout) error {
+	b.keyPrefixBytes = defaultKeyPrefixBytes
+	b.keyTemplate = nil
+	b.keyTemplateText = ""
+
+	switch {
+	case layout == nil:
+	case layout.KeyTemplate != "":
+		tmpl, err := parseKeyTemplate(layout.KeyTemplate)
+		if err != nil {
+			return err
+		}
+		b.keyTemplate = tmpl
+		b.keyTemplateText = layout.KeyTemplate
+	default:
+		b.keyPrefixBytes = layout.KeyPrefixBytes
+	}
+	return nil
+}
+
+func isValidKeyPrefixBytes(n int) bool {
+	return n >= 1 && n <= storeKeyDigits
+}
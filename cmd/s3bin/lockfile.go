@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const lockFileVersion = 1
+
+// LockFile is the contents of a lock file. It records the hash of every file
+// put by s3bin in a single place, as an alternative to .sha1 files.
+type LockFile struct {
+	Version int         `json:"version"`
+	Files   []LockEntry `json:"files"`
+}
+
+// LockEntry describes a single file in a lock file. Path is relative to the
+// directory containing the lock file, and always uses forward slashes.
+type LockEntry struct {
+	Path string `json:"path"`
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+func readLockFile(path string) (*LockFile, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &LockFile{Version: lockFileVersion}, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "failed to read lock file %q", path)
+	}
+
+	lock := &LockFile{}
+	err = json.Unmarshal(data, lock)
+	if err != nil {
+		return nil, errors.Wrapf(err, "lock file %q is invalid", path)
+	}
+
+	if lock.Version != lockFileVersion {
+		return nil, errors.Errorf(
+			"lock file %q has unsupported version %d", path, lock.Version)
+	}
+
+	for i := range lock.Files {
+		entry := &lock.Files[i]
+
+		// Entries are joined to the lock file's directory, so they must
+		// not lead out of it.
+		rel := filepath.Clean(filepath.FromSlash(entry.Path))
+		if entry.Path == "" || strings.HasPrefix(entry.Path, "/") ||
+			filepath.IsAbs(rel) || rel == "." || escapesRoot(rel) {
+			return nil, errors.Errorf(
+				"lock file %q has path %q outside of its directory", path, entry.Path)
+		}
+
+		entry.Hash = strings.ToLower(entry.Hash)
+		if !isValidHash(entry.Hash) {
+			return nil, errors.Errorf(
+				"lock file %q has invalid hash for %q", path, entry.Path)
+		}
+	}
+
+	// updateLockFile keeps entries sorted by path, but lock files edited
+	// by hand may not be.
+	sort.Slice(lock.Files, func(i, j int) bool {
+		return lock.Files[i].Path < lock.Files[j].Path
+	})
+
+	return lock, nil
+}
+
+func writeLockFile(path string, lock *LockFile) error {
+	data, err := json.MarshalIndent(lock, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "json.MarshalIndent(lock)")
+	}
+	data = append(data, '\n')
+
+	// Readers must never observe a partially written lock file.
+	return writeFileAtomic(path, data, 0644)
+}
+
+// lockEntryPath returns the path of file relative to the lock file's
+// directory, in the form stored in LockEntry.Path.
+func (b *s3Bin) lockEntryPath(file string) (string, error) {
+	lockDir, err := filepath.Abs(filepath.Dir(b.lockFile))
+	if err != nil {
+		return "", errors.Wrap(err, "failed to resolve lock file directory")
+	}
+
+	absFile, err := filepath.Abs(file)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to resolve %q", file)
+	}
+
+	rel, err := filepath.Rel(lockDir, absFile)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errors.Errorf(
+			"%q is not under the lock file's directory %q", file, lockDir)
+	}
+
+	return filepath.ToSlash(rel), nil
+}
+
+// updateLockFile adds or replaces the entry for file in the lock file.
+// Updates are serialized both within the process and, through an advisory
+// lock on a companion .lck file, across processes.
+func (b *s3Bin) updateLockFile(file, hash string, size int64) error {
+	entryPath, err := b.lockEntryPath(file)
+	if err != nil {
+		return err
+	}
+
+	b.lockMu.Lock()
+	defer b.lockMu.Unlock()
+
+	mutex, err := acquireFileLock(b.lockFile + ".lck")
+	if err != nil {
+		return err
+	}
+	defer mutex.release()
+
+	lock, err := readLockFile(b.lockFile)
+	if err != nil {
+		return err
+	}
+
+	entry := LockEntry{
+		Path: entryPath,
+		Hash: hash,
+		Size: size,
+	}
+
+	i := sort.Search(len(lock.Files), func(i int) bool {
+		return lock.Files[i].Path >= entryPath
+	})
+	if i < len(lock.Files) && lock.Files[i].Path == entryPath {
+		lock.Files[i] = entry
+	} else {
+		lock.Files = append(lock.Files, LockEntry{})
+		copy(lock.Files[i+1:], lock.Files[i:])
+		lock.Files[i] = entry
+	}
+
+	return writeLockFile(b.lockFile, lock)
+}
+
+func (b *s3Bin) getLocked(file string) error {
+	hash, err := b.lockedHash(file)
+	if err != nil {
+		return err
+	}
+
+	return b.getFile(file, hash)
+}
+
+// lockedHash returns the hash recorded for file in the lock file.
+func (b *s3Bin) lockedHash(file string) (string, error) {
+	entryPath, err := b.lockEntryPath(file)
+	if err != nil {
+		return "", err
+	}
+
+	err = b.checkHashFilePerms(b.lockFile)
+	if err != nil {
+		return "", err
+	}
+
+	lock, err := readLockFile(b.lockFile)
+	if err != nil {
+		return "", err
+	}
+
+	for _, entry := range lock.Files {
+		if entry.Path == entryPath {
+			return entry.Hash, nil
+		}
+	}
+
+	return "", errors.Wrapf(ErrNotLocked, "%q is not in lock file %q", file, b.lockFile)
+}
+
+// walkLocked queues the files under root in the lock file for GetDir.
+func (b *s3Bin) walkLocked(root string, run *getDirRun) error {
+	return b.forEachLocked(root, func(file, hash string) error {
+		run.sidecars++
+		return b.queueDirFile(run, file, hash)
+	})
+}
+
+// forEachLocked calls fn for every file under root in the lock file, with
+// the hash recorded for it.
+func (b *s3Bin) forEachLocked(root string, fn func(file, hash string) error) error {
+	rootPath, err := b.lockEntryPath(root)
+	if err != nil {
+		return err
+	}
+
+	err = b.checkHashFilePerms(b.lockFile)
+	if err != nil {
+		return err
+	}
+
+	lock, err := readLockFile(b.lockFile)
+	if err != nil {
+		return err
+	}
+
+	lockDir := filepath.Dir(b.lockFile)
+	for _, entry := range lock.Files {
+		if rootPath != "." && !strings.HasPrefix(entry.Path, rootPath+"/") {
+			continue
+		}
+
+		err = fn(filepath.Join(lockDir, filepath.FromSlash(entry.Path)), entry.Hash)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	onConflictFail  = "fail"
+	onConflictFirst = "first"
+	onConflictLast  = "last"
+)
+
+type mergedSidecar struct {
+	hash   string
+	source string
+}
+
+// mergeSidecars merges the .sha1 files of the srcDirs trees into dstDir,
+// keeping their paths relative to their tree. Two .sha1 files with the same
+// relative path and different hashes conflict: onConflict decides whether
+// that fails the merge, or whether the first or last of them wins. Nothing
+// is written if the merge fails.
+func mergeSidecars(srcDirs []string, dstDir, onConflict string) error {
+	if onConflict != onConflictFail && onConflict != onConflictFirst && onConflict != onConflictLast {
+		return errors.Errorf("invalid -on-conflict %q: must be %s, %s or %s",
+			onConflict, onConflictFail, onConflictFirst, onConflictLast)
+	}
+
+	merged := make(map[string]mergedSidecar)
+	conflicts := 0
+
+	for _, srcDir := range srcDirs {
+		err := filepath.Walk(
+			srcDir, func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+
+				if info.IsDir() || filepath.Ext(path) != ".sha1" {
+					return nil
+				}
+
+				hash, err := parseSidecarFile(path)
+				if err != nil {
+					return err
+				}
+
+				rel, err := filepath.Rel(srcDir, path)
+				if err != nil {
+					return errors.Wrapf(err, "failed to resolve %q", path)
+				}
+
+				prev, ok := merged[rel]
+				if ok && prev.hash != hash {
+					conflicts++
+					log.Printf("Conflict: %q is %s in %q, but %s in %q",
+						rel, prev.hash, prev.source, hash, srcDir)
+					if onConflict != onConflictLast {
+						return nil
+					}
+				}
+
+				merged[rel] = mergedSidecar{hash: hash, source: srcDir}
+				return nil
+			})
+		if err != nil {
+			return err
+		}
+	}
+
+	if conflicts > 0 && onConflict == onConflictFail {
+		return errors.Errorf("merge failed with %d conflicts", conflicts)
+	}
+
+	rels := make([]string, 0, len(merged))
+	for rel := range merged {
+		rels = append(rels, rel)
+	}
+	sort.Strings(rels)
+
+	for _, rel := range rels {
+		dstFile := filepath.Join(dstDir, rel)
+
+		err := os.MkdirAll(filepath.Dir(dstFile), 0755)
+		if err != nil {
+			return errors.Wrapf(err, "failed to create directory for %q", dstFile)
+		}
+
+		err = ioutil.WriteFile(dstFile, []byte(merged[rel].hash), 0644)
+		if err != nil {
+			return errors.Wrapf(err, "failed to create hash file %q", dstFile)
+		}
+	}
+
+	log.Printf("Merged %d .sha1 files into %q", len(rels), dstDir)
+	return nil
+}
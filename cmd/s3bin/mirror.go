@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/pkg/errors"
+)
+
+// mirrorMetadataSuffix is appended to the path of a mirrored object for the
+// file holding its metadata, which records the object's format.
+const mirrorMetadataSuffix = ".metadata.json"
+
+// Mirror copies the objects of every file recorded under root, as they are
+// stored, to the local directory store. Objects are laid out under store
+// as they are under the prefix, by its key layout, and each has its metadata next
+// to it. The chunks of chunked objects are copied as well. Objects that are
+// already in store are skipped, so Mirror can be run again to bring store
+// up-to-date. Objects are copied concurrently.
+func (b *s3Bin) Mirror(root, store string) error {
+	seen := make(map[string]bool)
+	var hashes []string
+	err := b.forEachRecorded(root, func(file, hash string) error {
+		if !seen[hash] {
+			seen[hash] = true
+			hashes = append(hashes, hash)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var copied int64
+	err = b.forEachHash(hashes, func(hash string) error {
+		n, err := b.mirrorObject(store, hash)
+		atomic.AddInt64(&copied, int64(n))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Mirrored %d hashes to %q, copying %d new objects", len(hashes), store, copied)
+	return nil
+}
+
+// mirrorObject copies the object for hash, and its chunks, to store. It
+// returns the number of objects that were copied.
+func (b *s3Bin) mirrorObject(store, hash string) (int, error) {
+	key, err := b.relativeKey(hash)
+	if err != nil {
+		return 0, err
+	}
+	path := filepath.Join(store, filepath.FromSlash(key))
+	metadataPath := path + mirrorMetadataSuffix
+
+	copied := 0
+	metadata, err := readMirrorMetadata(metadataPath)
+	if os.IsNotExist(errors.Cause(err)) {
+		metadata, err = b.copyObject(hash, path, metadataPath)
+		copied++
+	}
+	if err != nil {
+		return copied, err
+	}
+
+	if metadata[formatMetadata] != formatChunked {
+		return copied, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return copied, errors.Wrapf(err, "failed to open %q", path)
+	}
+	defer f.Close()
+
+	manifest := &chunkManifest{}
+	err = json.NewDecoder(f).Decode(manifest)
+	if err != nil {
+		return copied, errors.Wrapf(err, "failed to read chunk manifest %q", path)
+	}
+
+	for _, chunk := range manifest.Chunks {
+		n, err := b.mirrorObject(store, chunk.Hash)
+		copied += n
+		if err != nil {
+			return copied, err
+		}
+	}
+	return copied, nil
+}
+
+// copyObject downloads the object for hash to path, and its metadata to
+// metadataPath, which is written last: an object is only taken to be
+// mirrored once its metadata is there.
+func (b *s3Bin) copyObject(hash, path, metadataPath string) (map[string]string, error) {
+	ctx, cancel := b.objectContext()
+	defer cancel()
+
+	key, err := b.objectKey(hash)
+	if err != nil {
+		return nil, err
+	}
+	res, err := b.getObject(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	inflight, err := b.inflight.acquire(ctx, aws.Int64Value(res.ContentLength))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to wait to copy %q", key)
+	}
+	defer b.inflight.release(inflight)
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create directory for %q", path)
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".s3bin-")
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create temporary file for %q", path)
+	}
+	defer os.Remove(tmp.Name())
+
+	n, err := io.Copy(tmp, res.Body)
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to copy %q", key)
+	}
+	if res.ContentLength != nil && n != *res.ContentLength {
+		return nil, errors.Errorf("%q is truncated: read %d of %d bytes",
+			key, n, *res.ContentLength)
+	}
+
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to replace %q", path)
+	}
+
+	// The SDK canonicalizes the case of metadata keys; they are stored as
+	// S3 does, in lowercase.
+	metadata := make(map[string]string)
+	for k, v := range res.Metadata {
+		metadata[strings.ToLower(k)] = aws.StringValue(v)
+	}
+
+	data, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return nil, errors.Wrap(err, "json.MarshalIndent(metadata)")
+	}
+	err = writeFileAtomic(metadataPath, append(data, '\n'), 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return metadata, nil
+}
+
+func readMirrorMetadata(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %q", path)
+	}
+
+	metadata := make(map[string]string)
+	err = json.Unmarshal(data, &metadata)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%q is invalid", path)
+	}
+	return metadata, nil
+}
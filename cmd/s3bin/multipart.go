@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+)
+
+// With -resumable-uploads, objects of at least multipartThreshold bytes are
+// uploaded in parts of at least minPartSize bytes. The upload's state is
+// saved in -cache-dir after every part, so that putting the file again
+// after a failure only uploads the parts that are missing. Object bodies are
+// packed deterministically, so the parts of a new attempt are the same as
+// those of the last one; each part's MD5 is saved to make sure of that.
+const (
+	multipartThreshold = 64 << 20
+	minPartSize        = 16 << 20
+	maxParts           = 10000
+)
+
+// uploadState is the state of a multipart upload, as saved in -cache-dir.
+type uploadState struct {
+	Bucket   string         `json:"bucket"`
+	Key      string         `json:"key"`
+	Hash     string         `json:"hash"`
+	Size     int64          `json:"size"`
+	PartSize int64          `json:"part_size"`
+	UploadID string         `json:"upload_id"`
+	Parts    []uploadedPart `json:"parts"`
+}
+
+// uploadedPart is a part of a multipart upload that was uploaded.
+type uploadedPart struct {
+	Number   int64  `json:"number"`
+	ETag     string `json:"etag"`
+	MD5      string `json:"md5"`
+	Checksum string `json:"checksum,omitempty"`
+}
+
+// uploadStatePath returns the path of the state of the multipart upload of
+// the object at key.
+func (b *s3Bin) uploadStatePath(key string) string {
+	id := sha1.Sum([]byte(b.s3Bucket + "/" + key))
+	return filepath.Join(b.cacheDir, "uploads", hex.EncodeToString(id[:]))
+}
+
+// storeMultipart uploads the object of input, with size bytes of body, as a
+// resumable multipart upload. An upload of the object that was left
+// unfinished is resumed, if it is for the same content; otherwise it is
+// aborted, so that its parts are not left behind.
+func (b *s3Bin) storeMultipart(ctx context.Context, input *s3.PutObjectInput, size int64) error {
+	key := aws.StringValue(input.Key)
+	hash := aws.StringValue(input.Metadata[hashMetadata])
+	partSize := int64(minPartSize)
+	if size > partSize*maxParts {
+		partSize = (size + maxParts - 1) / maxParts
+	}
+
+	statePath := b.uploadStatePath(key)
+	err := os.MkdirAll(filepath.Dir(statePath), 0755)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create directory for %q", statePath)
+	}
+
+	// Processes sharing -cache-dir take turns at the upload of key: one
+	// resuming it while another uploads its parts would corrupt its state.
+	mutex, err := acquireFileLock(statePath + ".lck")
+	if err != nil {
+		return err
+	}
+	defer mutex.release()
+
+	state, err := readUploadState(statePath)
+	if err != nil {
+		return err
+	}
+
+	if state != nil && (state.Bucket != b.s3Bucket || state.Key != key ||
+		state.Hash != hash || state.Size != size || state.PartSize != partSize) {
+		b.abortUpload(state)
+		state = nil
+	}
+
+	if state != nil {
+		log.Printf("Resuming upload of %q with %d parts uploaded", key, len(state.Parts))
+	} else {
+		state, err = b.createUpload(ctx, input, size, partSize)
+		if err != nil {
+			return err
+		}
+		err = writeUploadState(statePath, state)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = b.uploadParts(ctx, input, state, statePath)
+	if err != nil {
+		return err
+	}
+
+	completed := make([]*s3.CompletedPart, len(state.Parts))
+	for i, part := range state.Parts {
+		completed[i] = &s3.CompletedPart{
+			PartNumber: aws.Int64(part.Number),
+			ETag:       aws.String(part.ETag),
+		}
+		if part.Checksum != "" {
+			setPartChecksum(completed[i], b.s3Checksum, part.Checksum)
+		}
+	}
+
+	_, err = b.s3Cli.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          input.Bucket,
+		Key:             input.Key,
+		UploadId:        aws.String(state.UploadID),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: completed},
+		RequestPayer:    b.requestPayer,
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to complete upload of %q", key)
+	}
+
+	os.Remove(statePath)
+	return nil
+}
+
+// createUpload starts the multipart upload of the object of input.
+func (b *s3Bin) createUpload(ctx context.Context, input *s3.PutObjectInput, size, partSize int64) (*uploadState, error) {
+	create := &s3.CreateMultipartUploadInput{
+		Bucket:                    input.Bucket,
+		Key:                       input.Key,
+		Metadata:                  input.Metadata,
+		StorageClass:              input.StorageClass,
+		ACL:                       input.ACL,
+		ObjectLockMode:            input.ObjectLockMode,
+		ObjectLockRetainUntilDate: input.ObjectLockRetainUntilDate,
+		RequestPayer:              b.requestPayer,
+	}
+	if b.s3Checksum != "" {
+		create.ChecksumAlgorithm = aws.String(b.s3Checksum)
+	}
+
+	res, err := b.s3Cli.CreateMultipartUploadWithContext(ctx, create)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to start upload of %q", aws.StringValue(input.Key))
+	}
+
+	return &uploadState{
+		Bucket:   b.s3Bucket,
+		Key:      aws.StringValue(input.Key),
+		Hash:     aws.StringValue(input.Metadata[hashMetadata]),
+		Size:     size,
+		PartSize: partSize,
+		UploadID: aws.StringValue(res.UploadId),
+	}, nil
+}
+
+// uploadParts uploads the parts of the body of input that are not in
+// state, and saves state after each of them.
+func (b *s3Bin) uploadParts(ctx context.Context, input *s3.PutObjectInput, state *uploadState, statePath string) error {
+	uploaded := make(map[int64]uploadedPart)
+	for _, part := range state.Parts {
+		uploaded[part.Number] = part
+	}
+
+	_, err := input.Body.Seek(0, io.SeekStart)
+	if err != nil {
+		return errors.Wrap(err, "failed to rewind file")
+	}
+
+	buf := make([]byte, state.PartSize)
+	var parts []uploadedPart
+	for number := int64(1); number*state.PartSize-state.PartSize < state.Size; number++ {
+		n, err := io.ReadFull(input.Body, buf)
+		if err == io.ErrUnexpectedEOF {
+			err = nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "failed to read file")
+		}
+		data := buf[:n]
+
+		sum := md5.Sum(data)
+		partMD5 := base64.StdEncoding.EncodeToString(sum[:])
+		if part, ok := uploaded[number]; ok {
+			if part.MD5 != partMD5 {
+				return errors.Errorf(
+					"part %d of the upload of %q changed since it was uploaded", number, state.Key)
+			}
+			progressFrom(ctx).add(nil, int64(n))
+			parts = append(parts, part)
+			continue
+		}
+
+		part := uploadedPart{Number: number, MD5: partMD5}
+		uploadInput := &s3.UploadPartInput{
+			Bucket:       aws.String(state.Bucket),
+			Key:          aws.String(state.Key),
+			UploadId:     aws.String(state.UploadID),
+			PartNumber:   aws.Int64(number),
+			Body:         bytes.NewReader(data),
+			ContentMD5:   aws.String(partMD5),
+			RequestPayer: b.requestPayer,
+		}
+		if b.s3Checksum != "" {
+			h := newChecksumHash(b.s3Checksum)
+			h.Write(data)
+			part.Checksum = base64.StdEncoding.EncodeToString(h.Sum(nil))
+			setUploadPartChecksum(uploadInput, b.s3Checksum, part.Checksum)
+		}
+
+		res, err := b.s3Cli.UploadPartWithContext(ctx, uploadInput)
+		if aerr, ok := errors.Cause(err).(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchUpload {
+			// The upload was aborted, e.g. by a lifecycle rule. The next
+			// attempt starts over.
+			os.Remove(statePath)
+			return errors.Wrapf(err, "upload of %q no longer exists", state.Key)
+		} else if err != nil {
+			return errors.Wrapf(err, "failed to upload part %d of %q", number, state.Key)
+		}
+		part.ETag = aws.StringValue(res.ETag)
+
+		parts = append(parts, part)
+		state.Parts = append(state.Parts, part)
+		err = writeUploadState(statePath, state)
+		if err != nil {
+			return err
+		}
+	}
+
+	state.Parts = parts
+	return nil
+}
+
+// abortUpload aborts the multipart upload of state, so that S3 deletes its
+// parts. Failing to abort it only leaves the parts behind, which is
+// reported and otherwise ignored.
+func (b *s3Bin) abortUpload(state *uploadState) {
+	_, err := b.s3Cli.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket:       aws.String(state.Bucket),
+		Key:          aws.String(state.Key),
+		UploadId:     aws.String(state.UploadID),
+		RequestPayer: b.requestPayer,
+	})
+	if err != nil {
+		log.Printf("Failed to abort the previous upload of %q: %v", state.Key, err)
+		return
+	}
+	log.Printf("Aborted the previous upload of %q", state.Key)
+}
+
+func readUploadState(path string) (*uploadState, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "failed to read upload state %q", path)
+	}
+
+	state := &uploadState{}
+	err = json.Unmarshal(data, state)
+	if err != nil {
+		// A state that cannot be read cannot be resumed, nor aborted.
+		log.Printf("Ignoring invalid upload state %q: %v", path, err)
+		return nil, nil
+	}
+	return state, nil
+}
+
+func writeUploadState(path string, state *uploadState) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create directory for %q", path)
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return errors.Wrap(err, "json.Marshal(state)")
+	}
+	return writeFileAtomic(path, data, 0644)
+}
+
+// setUploadPartChecksum sets the checksum of a part for S3 to check.
+func setUploadPartChecksum(input *s3.UploadPartInput, algorithm, checksum string) {
+	input.ChecksumAlgorithm = aws.String(algorithm)
+	switch algorithm {
+	case s3.ChecksumAlgorithmCrc32:
+		input.ChecksumCRC32 = aws.String(checksum)
+	case s3.ChecksumAlgorithmCrc32c:
+		input.ChecksumCRC32C = aws.String(checksum)
+	case s3.ChecksumAlgorithmSha1:
+		input.ChecksumSHA1 = aws.String(checksum)
+	case s3.ChecksumAlgorithmSha256:
+		input.ChecksumSHA256 = aws.String(checksum)
+	}
+}
+
+// setPartChecksum sets the checksum of a completed part, which S3 requires
+// for uploads with checksums.
+func setPartChecksum(part *s3.CompletedPart, algorithm, checksum string) {
+	switch algorithm {
+	case s3.ChecksumAlgorithmCrc32:
+		part.ChecksumCRC32 = aws.String(checksum)
+	case s3.ChecksumAlgorithmCrc32c:
+		part.ChecksumCRC32C = aws.String(checksum)
+	case s3.ChecksumAlgorithmSha1:
+		part.ChecksumSHA1 = aws.String(checksum)
+	case s3.ChecksumAlgorithmSha256:
+		part.ChecksumSHA256 = aws.String(checksum)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+)
+
+// parseObjectLock validates the -object-lock-mode and -object-lock-until
+// flags. Both must be set together, or not at all.
+func parseObjectLock(mode, until string) (*string, *time.Time, error) {
+	if mode == "" && until == "" {
+		return nil, nil, nil
+	}
+
+	if mode == "" || until == "" {
+		return nil, nil, errors.New(
+			"-object-lock-mode and -object-lock-until must be used together")
+	}
+
+	mode = strings.ToUpper(mode)
+	if mode != s3.ObjectLockModeGovernance && mode != s3.ObjectLockModeCompliance {
+		return nil, nil, errors.Errorf(
+			"invalid object lock mode %q: must be %s or %s",
+			mode, s3.ObjectLockModeGovernance, s3.ObjectLockModeCompliance)
+	}
+
+	untilTime, err := time.Parse(time.RFC3339, until)
+	if err != nil {
+		untilTime, err = time.Parse("2006-01-02", until)
+	}
+	if err != nil {
+		return nil, nil, errors.Errorf(
+			"invalid object lock date %q: must be RFC 3339 or YYYY-MM-DD", until)
+	}
+
+	if !untilTime.After(time.Now()) {
+		return nil, nil, errors.Errorf(
+			"object lock date %q is not in the future", until)
+	}
+
+	return aws.String(mode), &untilTime, nil
+}
+
+// explainLocked returns err, from writing or deleting the object at key,
+// with an explanation if the object is protected by object lock. S3 only
+// reports access as denied, which is otherwise hard to tell apart from
+// missing permissions.
+func (b *s3Bin) explainLocked(key string, err error) error {
+	if !isAccessDenied(err) {
+		return err
+	}
+
+	retention, rerr := b.s3Cli.GetObjectRetention(&s3.GetObjectRetentionInput{
+		Bucket:       aws.String(b.s3Bucket),
+		Key:          aws.String(key),
+		RequestPayer: b.requestPayer,
+	})
+	if rerr == nil && retention.Retention != nil {
+		until := aws.TimeValue(retention.Retention.RetainUntilDate)
+		if until.After(time.Now()) {
+			return errors.Wrapf(err, "object %q is under %s retention until %s",
+				key, aws.StringValue(retention.Retention.Mode), until.Format(time.RFC3339))
+		}
+	}
+
+	hold, herr := b.s3Cli.GetObjectLegalHold(&s3.GetObjectLegalHoldInput{
+		Bucket:       aws.String(b.s3Bucket),
+		Key:          aws.String(key),
+		RequestPayer: b.requestPayer,
+	})
+	if herr == nil && hold.LegalHold != nil &&
+		aws.StringValue(hold.LegalHold.Status) == s3.ObjectLockLegalHoldStatusOn {
+		return errors.Wrapf(err, "object %q is under a legal hold", key)
+	}
+
+	return err
+}
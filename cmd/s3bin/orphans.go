@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// ListOrphans prints to w every .sha1 file under root whose object is not
+// stored, with the missing hash. With -lock-file, the files under root in
+// the lock file are checked instead. Objects are checked concurrently, and
+// each hash is only checked once. ListOrphans fails if it finds any
+// orphans.
+func (b *s3Bin) ListOrphans(w io.Writer, root string) error {
+	refs := make(map[string][]string)
+	var hashes []string
+	err := b.forEachRecorded(root, func(file, hash string) error {
+		if refs[hash] == nil {
+			hashes = append(hashes, hash)
+		}
+		if b.lockFile == "" {
+			file += ".sha1"
+		}
+		refs[hash] = append(refs[hash], file)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var (
+		mu      sync.Mutex
+		missing []string
+	)
+	err = b.forEachHash(hashes, func(hash string) error {
+		exists, err := b.objectExists(hash)
+		if err == nil && !exists {
+			mu.Lock()
+			missing = append(missing, hash)
+			mu.Unlock()
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	type orphan struct {
+		file string
+		hash string
+	}
+	var orphans []orphan
+	for _, hash := range missing {
+		for _, file := range refs[hash] {
+			orphans = append(orphans, orphan{file: file, hash: hash})
+		}
+	}
+	sort.Slice(orphans, func(i, j int) bool {
+		return orphans[i].file < orphans[j].file
+	})
+
+	for _, o := range orphans {
+		fmt.Fprintf(w, "%s\t%s\n", o.file, o.hash)
+	}
+
+	if len(orphans) > 0 {
+		return errors.Errorf("%d of %d objects referenced under %q are missing",
+			len(missing), len(refs), root)
+	}
+	return nil
+}
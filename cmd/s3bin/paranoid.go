@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+// compareObject checks that the object already stored for hash has content
+// data. With -paranoid, chunked puts do so before skipping a chunk that is
+// already stored, so that a chunk that collides with a different one is
+// reported instead of silently replaced by it in the manifest.
+func (b *s3Bin) compareObject(hash string, data []byte) error {
+	ctx, cancel := b.objectContext()
+	defer cancel()
+
+	key, err := b.objectKey(hash)
+	if err != nil {
+		return err
+	}
+	res, err := b.getObject(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	content, err := b.openContent(ctx, res)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read %q", key)
+	}
+
+	// Read one byte more than expected, so that a longer object is told
+	// apart from an equal one.
+	stored, err := ioutil.ReadAll(io.LimitReader(content.data, int64(len(data))+1))
+	if err == nil && len(stored) == len(data) {
+		err = content.finish()
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to read %q", key)
+	}
+
+	if !bytes.Equal(stored, data) {
+		return errors.Wrapf(ErrHashCollision,
+			"object %q has hash %s but different content (%d bytes, expected %d)",
+			key, hash, len(stored), len(data))
+	}
+	return nil
+}
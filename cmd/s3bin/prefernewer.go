@@ -0,0 +1,36 @@
+package main
+
+import (
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+)
+
+// objectIsNewer returns whether the object for hash was last modified after
+// targetFile. -prefer-newer only replaces local files that differ from
+// their .sha1 file with objects that are newer than them.
+func (b *s3Bin) objectIsNewer(targetFile, hash string) (bool, error) {
+	info, err := os.Stat(targetFile)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to read attributes of %q", targetFile)
+	}
+
+	key, err := b.objectKey(hash)
+	if err != nil {
+		return false, err
+	}
+	head, err := b.s3Cli.HeadObject(&s3.HeadObjectInput{
+		Bucket:       aws.String(b.s3Bucket),
+		Key:          aws.String(key),
+		VersionId:    b.versionID,
+		RequestPayer: b.requestPayer,
+	})
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to read %q in S3 bucket %q",
+			key, b.s3Bucket)
+	}
+
+	return aws.TimeValue(head.LastModified).After(info.ModTime()), nil
+}
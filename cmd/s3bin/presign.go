@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+)
+
+// maxPresignExpiry is the longest S3 honors a presigned URL for.
+const maxPresignExpiry = 7 * 24 * time.Hour
+
+// Presign writes to w a URL anyone can GET the object for file from, without
+// credentials, until expires has passed. The URL returns the object as it
+// is stored, so it is only the file itself for objects stored raw. Objects
+// stored in any other format, e.g. tar.gz, are refused unless raw is set.
+// For raw objects, the URL tells browsers to save the download under the
+// file's name.
+func (b *s3Bin) Presign(w io.Writer, file string, expires time.Duration, raw bool) error {
+	if expires <= 0 || expires > maxPresignExpiry {
+		return errors.Errorf("-expires must be between 1s and %v", maxPresignExpiry)
+	}
+
+	hash, err := b.recordedHash(file)
+	if err != nil {
+		return err
+	}
+
+	key, err := b.objectKey(hash)
+	if err != nil {
+		return err
+	}
+	head, err := b.s3Cli.HeadObject(&s3.HeadObjectInput{
+		Bucket:       aws.String(b.s3Bucket),
+		Key:          aws.String(key),
+		VersionId:    b.versionID,
+		RequestPayer: b.requestPayer,
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to read %q in S3 bucket %q", key, b.s3Bucket)
+	}
+
+	input := &s3.GetObjectInput{
+		Bucket:       aws.String(b.s3Bucket),
+		Key:          aws.String(key),
+		VersionId:    b.versionID,
+		RequestPayer: b.requestPayer,
+	}
+
+	format := metadataValue(head.Metadata, formatMetadata)
+	if format == formatRaw {
+		name := strings.TrimSuffix(filepath.Base(file), ".sha1")
+		input.ResponseContentDisposition = aws.String(
+			fmt.Sprintf("attachment; filename=%q", name))
+	} else if !raw {
+		if format == "" {
+			format = "an unknown format"
+		}
+		return errors.Errorf(
+			"%q is stored as %s, not as the file itself; use -presign-raw to presign it as stored",
+			key, format)
+	}
+
+	req, _ := b.s3Cli.GetObjectRequest(input)
+	url, err := req.Presign(expires)
+	if err != nil {
+		return errors.Wrapf(err, "failed to presign %q", key)
+	}
+
+	fmt.Fprintln(w, url)
+	return nil
+}
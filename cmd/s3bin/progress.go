@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// progressInterval is how often -progress-json reports transfers.
+const progressInterval = time.Second
+
+// progressReport is a line of -progress-json output. Total is -1 if the
+// size of the content is unknown.
+type progressReport struct {
+	File        string `json:"file"`
+	Transferred int64  `json:"transferred"`
+	Total       int64  `json:"total"`
+}
+
+// progressKey is the context key of the progress of the transfer a request
+// is part of.
+type progressKey struct{}
+
+// progress counts the bytes transferred for a file out of its total: the
+// object's body for uploads, and the file's content for downloads. A nil
+// progress counts nothing.
+type progress struct {
+	name  string
+	total int64
+
+	mu sync.Mutex
+	n  int64
+
+	// sent is the number of bytes of each request's body sent by its last
+	// attempt, which no longer count if the request is retried.
+	sent map[*request.Request]int64
+}
+
+// setProgressJSON turns on -progress-json.
+func (b *s3Bin) setProgressJSON() {
+	b.progressJSON = true
+	b.setRegion(aws.StringValue(b.s3Cli.Config.Region))
+}
+
+// startProgress starts reporting the progress of the transfer of total
+// bytes for name every progressInterval, if -progress-json is set. The
+// returned function must be called once the transfer is over, and reports
+// it a last time.
+func (b *s3Bin) startProgress(name string, total int64) (*progress, func()) {
+	if !b.progressJSON {
+		return nil, func() {}
+	}
+
+	p := &progress{
+		name:  name,
+		total: total,
+		sent:  make(map[*request.Request]int64),
+	}
+	p.report()
+
+	ticker := time.NewTicker(progressInterval)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				p.report()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return p, func() {
+		ticker.Stop()
+		close(done)
+		p.report()
+	}
+}
+
+// withProgress returns ctx with p, so that the bodies of the requests made
+// with it are counted in p.
+func withProgress(ctx context.Context, p *progress) context.Context {
+	if p == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, progressKey{}, p)
+}
+
+// progressFrom returns the progress in ctx, or nil.
+func progressFrom(ctx context.Context) *progress {
+	p, _ := ctx.Value(progressKey{}).(*progress)
+	return p
+}
+
+// report writes the state of p to stderr as a line of JSON. It is written
+// at once, so that it does not interleave with log output.
+func (p *progress) report() {
+	p.mu.Lock()
+	line, err := json.Marshal(&progressReport{
+		File:        p.name,
+		Transferred: p.n,
+		Total:       p.total,
+	})
+	p.mu.Unlock()
+	if err != nil {
+		return
+	}
+	os.Stderr.Write(append(line, '\n'))
+}
+
+// Write counts data as transferred.
+func (p *progress) Write(data []byte) (int, error) {
+	p.add(nil, int64(len(data)))
+	return len(data), nil
+}
+
+// add counts n bytes as transferred, sent by r if it is not nil.
+func (p *progress) add(r *request.Request, n int64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	p.n += n
+	if r != nil {
+		p.sent[r] += n
+	}
+	p.mu.Unlock()
+}
+
+// restart discounts the bytes sent by the previous attempt of r.
+func (p *progress) restart(r *request.Request) {
+	p.mu.Lock()
+	p.n -= p.sent[r]
+	p.sent[r] = 0
+	p.mu.Unlock()
+}
+
+// trackProgress is a Send handler that counts the bytes of the request body
+// sent in the progress of the request's context.
+func (b *s3Bin) trackProgress(r *request.Request) {
+	p := progressFrom(r.Context())
+	if p == nil || r.HTTPRequest.Body == nil || r.HTTPRequest.Body == http.NoBody {
+		return
+	}
+
+	p.restart(r)
+	r.HTTPRequest.Body = &progressReadCloser{
+		ReadCloser: r.HTTPRequest.Body,
+		p:          p,
+		r:          r,
+	}
+}
+
+// progressReadCloser counts the bytes read from an io.ReadCloser in a
+// progress.
+type progressReadCloser struct {
+	io.ReadCloser
+	p *progress
+	r *request.Request
+}
+
+func (c *progressReadCloser) Read(data []byte) (int, error) {
+	n, err := c.ReadCloser.Read(data)
+	c.p.add(c.r, int64(n))
+	return n, err
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"log"
+	"net/url"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+)
+
+// Promote copies the object for sha1File from the configured prefix to
+// toPrefix. The copy is done server-side, so the object is not downloaded.
+// The .sha1 file stays valid, since the content and its hash do not change.
+// The chunks of chunked objects are promoted as well.
+// The copy is made with the settings of uploads, and -max-prefix-bytes and
+// -max-prefix-objects limit the objects under toPrefix.
+func (b *s3Bin) Promote(sha1File, toPrefix string) error {
+	hash, err := b.readSidecar(sha1File)
+	if err != nil {
+		return err
+	}
+
+	// The object is found under the destination prefix with its layout,
+	// which must be the same as the source's.
+	dstLayout, err := b.readKeyLayout(toPrefix)
+	if err != nil {
+		return err
+	}
+	err = b.loadKeyLayout()
+	if err != nil {
+		return err
+	}
+	srcLayout := b.currentLayout()
+	if dstLayout == nil && srcLayout != nil {
+		dstLayout = srcLayout
+		err = b.writeKeyLayout(toPrefix, dstLayout)
+		if err != nil {
+			return err
+		}
+	}
+	if !sameLayout(dstLayout, srcLayout) {
+		return errors.Errorf("prefix %q uses %s, but %q uses %s",
+			toPrefix, describeLayout(dstLayout), b.prefix, describeLayout(srcLayout))
+	}
+
+	srcKey, dstKey, err := b.promotedKeys(hash, toPrefix)
+	if err != nil {
+		return err
+	}
+	if srcKey == dstKey {
+		return errors.Errorf("%q is already under prefix %q", srcKey, toPrefix)
+	}
+
+	head, err := b.headKey(srcKey)
+	if err != nil {
+		return err
+	}
+
+	// The chunks of a chunked object are copied before its manifest, so
+	// that the object is never found under toPrefix without them.
+	q := b.quotaFor(toPrefix)
+	if metadataValue(head.Metadata, formatMetadata) == formatChunked {
+		manifest, err := b.readManifest(srcKey)
+		if err != nil {
+			return err
+		}
+		for _, chunk := range manifest.Chunks {
+			chunkSrc, chunkDst, err := b.promotedKeys(chunk.Hash, toPrefix)
+			if err != nil {
+				return err
+			}
+			err = b.promoteKey(chunkSrc, chunkDst, q)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err = b.copyKey(srcKey, dstKey, nil, aws.Int64Value(head.ContentLength), q)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Promoted %q to %q", srcKey, dstKey)
+	return nil
+}
+
+// promotedKeys returns the key of the object for hash under the configured
+// prefix, and the key it is promoted to under toPrefix.
+func (b *s3Bin) promotedKeys(hash, toPrefix string) (string, string, error) {
+	key, err := b.relativeKey(hash)
+	if err != nil {
+		return "", "", err
+	}
+	return prefixedKey(b.prefix, key), prefixedKey(toPrefix, key), nil
+}
+
+// promoteKey copies the object at srcKey to dstKey, counting it towards q.
+func (b *s3Bin) promoteKey(srcKey, dstKey string, q *prefixQuota) error {
+	head, err := b.headKey(srcKey)
+	if err != nil {
+		return err
+	}
+	return b.copyKey(srcKey, dstKey, nil, aws.Int64Value(head.ContentLength), q)
+}
+
+// headKey returns the properties of the object at key.
+func (b *s3Bin) headKey(key string) (*s3.HeadObjectOutput, error) {
+	head, err := b.s3Cli.HeadObject(&s3.HeadObjectInput{
+		Bucket:       aws.String(b.s3Bucket),
+		Key:          aws.String(key),
+		RequestPayer: b.requestPayer,
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %q in S3 bucket %q",
+			key, b.s3Bucket)
+	}
+	return head, nil
+}
+
+// copySource returns the URL-encoded CopySource of a CopyObject request.
+func copySource(bucket, key string) string {
+	return (&url.URL{Path: bucket + "/" + key}).EscapedPath()
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"log"
+	"os"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// PutKey uploads the file at path under key instead of under its hash, for
+// consumers that fetch objects by a fixed name. The file's hash is recorded
+// as with Put, and stored in the object's metadata so that GetKey can
+// verify the content.
+func (b *s3Bin) PutKey(path, key string) error {
+	hash, err := calcSha1(path, b.ioBufferSize)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.Wrap(err, "failed to open file")
+	}
+	defer f.Close()
+
+	fstat, err := f.Stat()
+	if err != nil {
+		return errors.Wrap(err, "failed to read file attributes")
+	}
+
+	header, err := b.fileHeader(path)
+	if err != nil {
+		return err
+	}
+
+	stop := b.heartbeat(path)
+	err = b.putObjectAt(key, hash, header, f, fstat.Size(), b.fileMode(fstat), path)
+	stop()
+	if err != nil {
+		return err
+	}
+
+	// Close the file before it can be deleted by -delete-source.
+	f.Close()
+
+	err = b.recordHash(path, hash, fstat.Size())
+	if err != nil {
+		return err
+	}
+	b.summary.add(path, hash, resultUploaded, nil)
+
+	return b.deleteSource(path)
+}
+
+// GetKey downloads the object stored under key by PutKey to outFile, and
+// checks it against the hash in the object's metadata.
+func (b *s3Bin) GetKey(key, outFile string) error {
+	ctx, cancel := b.objectContext()
+	defer cancel()
+
+	res, err := b.getObject(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	hash := normalizeHash(metadataValue(res.Metadata, hashMetadata))
+	if !isValidHash(hash) {
+		return errors.Errorf("object %q does not have a valid %s metadata value",
+			key, hashMetadata)
+	}
+
+	existingHash, err := calcSha1(outFile, b.ioBufferSize)
+	if err == nil {
+		if existingHash == hash {
+			log.Printf("%q exists and is up-to-date", outFile)
+			atomic.AddInt64(&b.stats.FilesSkipped, 1)
+			b.summary.add(outFile, hash, resultSkipped, nil)
+			return nil
+		}
+		log.Printf("Updating %q", outFile)
+	} else if os.IsNotExist(errors.Cause(err)) {
+		log.Printf("Downloading %q", outFile)
+	} else {
+		return err
+	}
+
+	stop := b.heartbeat(outFile)
+	err = b.saveObject(ctx, res, key, outFile, hash, true)
+	stop()
+	if err != nil {
+		b.summary.add(outFile, hash, resultFailed, err)
+		return err
+	}
+
+	atomic.AddInt64(&b.stats.FilesDownloaded, 1)
+	b.summary.add(outFile, hash, resultDownloaded, nil)
+	return b.runDownloadHook(outFile)
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+)
+
+// usageCacheTTL is how long the usage of a prefix, cached in -cache-dir,
+// is used before the prefix is listed again.
+const usageCacheTTL = 10 * time.Minute
+
+// prefixQuota enforces -max-prefix-bytes and -max-prefix-objects on the
+// objects stored under prefix.
+type prefixQuota struct {
+	prefix     string
+	maxBytes   int64
+	maxObjects int64
+
+	mu     sync.Mutex
+	usage  *prefixUsage
+	cached string
+}
+
+// prefixUsage is the total size and number of the objects under a prefix.
+type prefixUsage struct {
+	Bucket  string    `json:"bucket"`
+	Prefix  string    `json:"prefix"`
+	Bytes   int64     `json:"bytes"`
+	Objects int64     `json:"objects"`
+	Time    time.Time `json:"time"`
+}
+
+// checkQuota refuses to store an object of size bytes under key if that
+// would take the prefix of q over q. A nil q allows any object. An object
+// that replaces one with the same key, as when a file is put again, does
+// not add to the usage of the prefix, so it is always allowed.
+func (b *s3Bin) checkQuota(q *prefixQuota, key string, size int64) error {
+	if q == nil {
+		return nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.usage == nil {
+		err := b.loadUsage(q)
+		if err != nil {
+			return err
+		}
+	}
+
+	var exceeded string
+	var limit int64
+	if q.maxBytes > 0 && q.usage.Bytes+size > q.maxBytes {
+		exceeded, limit = "-max-prefix-bytes", q.maxBytes
+	} else if q.maxObjects > 0 && q.usage.Objects+1 > q.maxObjects {
+		exceeded, limit = "-max-prefix-objects", q.maxObjects
+	}
+	if exceeded == "" {
+		return nil
+	}
+
+	exists, err := b.keyExists(key)
+	if err != nil || exists {
+		return err
+	}
+
+	return errors.Errorf(
+		"storing %q (%d bytes) would exceed %s %d: prefix %q has %d objects of %d bytes",
+		key, size, exceeded, limit, q.prefix, q.usage.Objects, q.usage.Bytes)
+}
+
+// addUsage records an object of size bytes stored by s3bin. Objects that
+// replace others are counted as well, so the usage errs on the high side
+// until the prefix is listed again.
+func (b *s3Bin) addUsage(q *prefixQuota, size int64) {
+	if q == nil {
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.usage == nil {
+		return
+	}
+
+	if q.cached == "" {
+		q.usage.Bytes += size
+		q.usage.Objects++
+		return
+	}
+
+	// Other processes sharing -cache-dir may have stored objects since the
+	// usage was loaded. The cached usage is updated under a lock, so that
+	// their additions are neither lost nor lose this one.
+	mutex, err := acquireFileLock(q.cached + ".lck")
+	if err == nil {
+		defer mutex.release()
+		if cached := readUsage(q.cached, q.usage.Bucket, q.usage.Prefix); cached != nil &&
+			!cached.Time.Before(q.usage.Time) {
+			q.usage = cached
+		}
+	}
+	q.usage.Bytes += size
+	q.usage.Objects++
+
+	if err == nil {
+		// Failing to cache the usage only makes the next run list the
+		// prefix again.
+		writeUsage(q.cached, q.usage)
+	}
+}
+
+// loadUsage sets the usage of the prefix of q, from -cache-dir if it was
+// cached recently enough, and otherwise by listing the prefix.
+func (b *s3Bin) loadUsage(q *prefixQuota) error {
+	listPrefix := strings.Trim(q.prefix, "/")
+	if listPrefix != "" {
+		listPrefix += "/"
+	}
+
+	if b.cacheDir != "" {
+		id := sha1.Sum([]byte(b.s3Bucket + "/" + listPrefix))
+		q.cached = filepath.Join(b.cacheDir, "usage-"+hex.EncodeToString(id[:]))
+
+		if usage := readUsage(q.cached, b.s3Bucket, listPrefix); usage != nil {
+			q.usage = usage
+			return nil
+		}
+	}
+
+	// The key layout object of the prefix is not one of its objects.
+	layout := layoutKey(q.prefix)
+	usage := &prefixUsage{
+		Bucket: b.s3Bucket,
+		Prefix: listPrefix,
+		Time:   time.Now(),
+	}
+	err := b.s3Cli.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket:       aws.String(b.s3Bucket),
+		Prefix:       aws.String(listPrefix),
+		RequestPayer: b.requestPayer,
+	}, func(page *s3.ListObjectsV2Output, last bool) bool {
+		for _, obj := range page.Contents {
+			if aws.StringValue(obj.Key) == layout {
+				continue
+			}
+			usage.Bytes += aws.Int64Value(obj.Size)
+			usage.Objects++
+		}
+		return true
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to list objects in S3 bucket %q", b.s3Bucket)
+	}
+
+	q.usage = usage
+	if q.cached != "" {
+		writeUsage(q.cached, usage)
+	}
+	return nil
+}
+
+// readUsage returns the usage of prefix of bucket cached at path, or nil if
+// there is none, or it is older than usageCacheTTL.
+func readUsage(path, bucket, prefix string) *prefixUsage {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+
+	usage := &prefixUsage{}
+	if json.Unmarshal(data, usage) != nil || usage.Bucket != bucket ||
+		usage.Prefix != prefix || time.Since(usage.Time) >= usageCacheTTL {
+		return nil
+	}
+	return usage
+}
+
+// writeUsage caches usage at path. It is written atomically, so that
+// processes sharing -cache-dir never read a partial file.
+func writeUsage(path string, usage *prefixUsage) error {
+	data, err := json.Marshal(usage)
+	if err != nil {
+		return errors.Wrap(err, "json.Marshal(usage)")
+	}
+	return writeFileAtomic(path, data, 0644)
+}
+
+// quotaFor returns a quota with the limits of the configured prefix's for
+// the objects under prefix, or nil if there are no limits.
+func (b *s3Bin) quotaFor(prefix string) *prefixQuota {
+	if b.quota == nil {
+		return nil
+	}
+	return &prefixQuota{
+		prefix:     prefix,
+		maxBytes:   b.quota.maxBytes,
+		maxObjects: b.quota.maxObjects,
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/pkg/errors"
+)
+
+// bandwidthLimiter is a token bucket that caps the combined rate of every
+// transfer that reads through it. Readers take tokens for the bytes they
+// have read, and wait out any deficit, so concurrent transfers share the
+// rate between them.
+type bandwidthLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newBandwidthLimiter(bytesPerSecond int64) *bandwidthLimiter {
+	return &bandwidthLimiter{
+		rate: float64(bytesPerSecond),
+		last: time.Now(),
+	}
+}
+
+// wait takes n tokens, and blocks until the bucket is no longer in deficit
+// or ctx is done.
+func (l *bandwidthLimiter) wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	// Allow bursts of up to a second's worth of data.
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	deficit := -l.tokens
+	l.mu.Unlock()
+
+	if deficit <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(time.Duration(deficit / l.rate * float64(time.Second)))
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// throttle is a Send handler that makes the request body read through the
+// limiter.
+func (l *bandwidthLimiter) throttle(r *request.Request) {
+	if r.HTTPRequest.Body != nil && r.HTTPRequest.Body != http.NoBody {
+		r.HTTPRequest.Body = &throttledReadCloser{
+			ReadCloser: r.HTTPRequest.Body,
+			ctx:        r.Context(),
+			limiter:    l,
+		}
+	}
+}
+
+// throttleResponse is a Send handler that makes the response body read
+// through the limiter.
+func (l *bandwidthLimiter) throttleResponse(r *request.Request) {
+	if r.HTTPResponse != nil && r.HTTPResponse.Body != nil {
+		r.HTTPResponse.Body = &throttledReadCloser{
+			ReadCloser: r.HTTPResponse.Body,
+			ctx:        r.Context(),
+			limiter:    l,
+		}
+	}
+}
+
+type throttledReadCloser struct {
+	io.ReadCloser
+	ctx     context.Context
+	limiter *bandwidthLimiter
+}
+
+func (r *throttledReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		if waitErr := r.limiter.wait(r.ctx, n); waitErr != nil && err == nil {
+			err = waitErr
+		}
+	}
+	return n, err
+}
+
+// parseBandwidth parses a rate in bytes per second, with an optional K, M
+// or G suffix for powers of 1024.
+func parseBandwidth(s string) (int64, error) {
+	n, ok := parseSize(s)
+	if !ok {
+		return 0, errors.Errorf("invalid bandwidth %q", s)
+	}
+	return n, nil
+}
+
+// parseSize parses a positive number of bytes, with an optional K, M or G
+// suffix for powers of 1024.
+func parseSize(s string) (int64, bool) {
+	multiplier := int64(1)
+	digits := strings.ToUpper(strings.TrimSpace(s))
+	switch {
+	case strings.HasSuffix(digits, "K"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(digits, "M"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(digits, "G"):
+		multiplier = 1 << 30
+	}
+	if multiplier != 1 {
+		digits = digits[:len(digits)-1]
+	}
+
+	n, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil || n <= 0 || n > math.MaxInt64/multiplier {
+		return 0, false
+	}
+	return n * multiplier, true
+}
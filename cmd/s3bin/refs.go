@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// findRefs prints the path of every .sha1 file under root that refers to
+// hash to w. Invalid .sha1 files are reported and skipped.
+func findRefs(w io.Writer, hash, root string) error {
+	hash = normalizeHash(hash)
+	if !isValidHash(hash) {
+		return errors.Errorf("%q is not a valid hash", hash)
+	}
+
+	return filepath.Walk(
+		root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			if info.IsDir() || filepath.Ext(path) != ".sha1" {
+				return nil
+			}
+
+			sidecarHash, err := parseSidecarFile(path)
+			if err != nil {
+				log.Printf("Skipping: %v", err)
+				return nil
+			}
+
+			if sidecarHash == hash {
+				_, err = fmt.Fprintln(w, path)
+				return err
+			}
+			return nil
+		})
+}
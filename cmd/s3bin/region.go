@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/pkg/errors"
+)
+
+// regionHint is the region the bucket's region is looked up from when it is
+// not given.
+const regionHint = "us-east-1"
+
+// resolveRegion looks up the bucket's region, and switches the S3 client to
+// it.
+func (b *s3Bin) resolveRegion() error {
+	region, err := s3manager.GetBucketRegion(
+		context.Background(), b.sess, b.s3Bucket, regionHint)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get the region of S3 bucket %q", b.s3Bucket)
+	}
+
+	b.setRegion(region)
+	return nil
+}
+
+// parseS3URI parses an s3://bucket/prefix URI.
+func parseS3URI(uri string) (bucket, prefix string, err error) {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "s3" || u.Host == "" {
+		return "", "", errors.Errorf("%q is not an s3://bucket/prefix URI", uri)
+	}
+	return u.Host, strings.Trim(u.Path, "/"), nil
+}
+
+// isRegionError returns whether err is caused by S3 redirecting a request
+// because the bucket is in a different region than the client's.
+func isRegionError(err error) bool {
+	aerr, ok := errors.Cause(err).(awserr.Error)
+	return ok && aerr.Code() == "BucketRegionError"
+}
+
+// recordBucketRegion is an UnmarshalError handler that records the region
+// named by region redirects, which the SDK leaves out of the error.
+func (b *s3Bin) recordBucketRegion(r *request.Request) {
+	if r.HTTPResponse.StatusCode != http.StatusMovedPermanently {
+		return
+	}
+
+	region := r.HTTPResponse.Header.Get("x-amz-bucket-region")
+	if region != "" {
+		b.bucketRegion.Store(region)
+	}
+}
+
+// redirectRegion switches the S3 client to the bucket's actual region if
+// err is caused by a region redirect. It returns whether it did, in which
+// case the failed operation can be retried.
+func (b *s3Bin) redirectRegion(err error) bool {
+	if !isRegionError(err) {
+		return false
+	}
+
+	clientRegion := aws.StringValue(b.s3Cli.Config.Region)
+
+	region, _ := b.bucketRegion.Load().(string)
+	if region == "" {
+		// Not every redirect names the bucket's region. Ask S3 for it.
+		region, err = s3manager.GetBucketRegionWithClient(
+			context.Background(), b.s3Cli, b.s3Bucket)
+		if err != nil {
+			log.Printf("Failed to get the region of S3 bucket %q: %v", b.s3Bucket, err)
+			return false
+		}
+	}
+
+	if region == "" || region == clientRegion {
+		return false
+	}
+
+	log.Printf("Warning: S3 bucket %q is in region %s, not %s; retrying in %s",
+		b.s3Bucket, region, clientRegion, region)
+	b.setRegion(region)
+	return true
+}
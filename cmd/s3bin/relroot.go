@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// With -relative-root, JSON .sha1 files record the path of their file
+// relative to the root, and GetDir restores each file at that path under
+// the root, wherever the .sha1 files themselves are. A set of .sha1 files
+// then restores the same tree wherever the root is, e.g. in another
+// checkout.
+
+// rootRelativePath returns the path of file relative to -relative-root, in
+// the form stored in jsonSidecar.Path.
+func (b *s3Bin) rootRelativePath(file string) (string, error) {
+	root, err := filepath.Abs(b.relativeRoot)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to resolve -relative-root")
+	}
+
+	absFile, err := filepath.Abs(file)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to resolve %q", file)
+	}
+
+	rel, err := filepath.Rel(root, absFile)
+	if err != nil || rel == "." || escapesRoot(rel) {
+		return "", errors.Errorf("%q is not under -relative-root %q", file, b.relativeRoot)
+	}
+
+	return filepath.ToSlash(rel), nil
+}
+
+// sidecarTarget returns the file that GetDir restores from sha1File. With
+// -relative-root, it is the path recorded in a JSON sha1File under the
+// root, whose directory is created if necessary; otherwise, or if sha1File
+// records no path, it is sha1File without its extension.
+func (b *s3Bin) sidecarTarget(sha1File string) (string, error) {
+	targetFile := strings.TrimSuffix(sha1File, ".sha1")
+	if b.relativeRoot == "" {
+		return targetFile, nil
+	}
+
+	data, err := ioutil.ReadFile(sha1File)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to read sha1 file %q", sha1File)
+	}
+
+	trimmed := strings.TrimSpace(strings.TrimPrefix(string(data), "\ufeff"))
+	if !strings.HasPrefix(trimmed, "{") {
+		return targetFile, nil
+	}
+
+	var sidecar jsonSidecar
+	err = json.Unmarshal([]byte(trimmed), &sidecar)
+	if err != nil || sidecar.Path == "" {
+		return targetFile, nil
+	}
+
+	rel := filepath.FromSlash(sidecar.Path)
+	if filepath.IsAbs(rel) || escapesRoot(filepath.Clean(rel)) {
+		return "", errors.Wrapf(ErrInvalidSidecar,
+			"sha1 file %q has path %q outside of the root", sha1File, sidecar.Path)
+	}
+
+	targetFile = filepath.Join(b.relativeRoot, rel)
+	err = os.MkdirAll(filepath.Dir(targetFile), 0755)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to create directory for %q", targetFile)
+	}
+	return targetFile, nil
+}
+
+// escapesRoot returns whether rel, a clean relative path, leads out of the
+// directory it is relative to.
+func escapesRoot(rel string) bool {
+	return rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
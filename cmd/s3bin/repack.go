@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/pkg/errors"
+)
+
+// Repack stores the object for file again in the format selected by the
+// options of -put, e.g. to compress objects stored with -raw, without the
+// original file. The object is downloaded and checked against its hash,
+// and its content and header are packed anew and uploaded under the same
+// key. file is a .sha1 file, or with -lock-file, the file itself, and stays
+// valid, since the content does not change. Chunked objects cannot be
+// repacked.
+func (b *s3Bin) Repack(file string) error {
+	hash, err := b.recordedHash(file)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := b.objectContext()
+	defer cancel()
+
+	key, err := b.objectKey(hash)
+	if err != nil {
+		return err
+	}
+	res, err := b.getObject(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	storedSize := aws.Int64Value(res.ContentLength)
+
+	content, err := b.openContent(ctx, res)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read %q", key)
+	}
+	if content.manifest != nil {
+		return errors.Errorf("%q is chunked, and cannot be repacked", key)
+	}
+
+	tmp, err := ioutil.TempFile("", "s3bin-")
+	if err != nil {
+		return errors.Wrap(err, "failed to create temporary file")
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := sha1.New()
+	size, err := io.Copy(io.MultiWriter(tmp, h), content.data)
+	if err == nil {
+		err = content.checkSize(size)
+	}
+	if err == nil {
+		err = content.finish()
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to download %q", key)
+	}
+
+	actual := hex.EncodeToString(h.Sum(nil))
+	if actual != hash {
+		return errors.Wrapf(ErrHashMismatch, "object %q has hash %s, expected %s",
+			key, actual, hash)
+	}
+
+	_, err = tmp.Seek(0, io.SeekStart)
+	if err != nil {
+		return errors.Wrap(err, "failed to rewind temporary file")
+	}
+
+	header := content.header
+	if header == nil {
+		header = &Header{Version: version}
+	}
+
+	// The compression is chosen anew, by -compress auto-best or not at all.
+	header.Codec = ""
+	header.Level = 0
+
+	mode := os.FileMode(0644)
+	if content.hasMode {
+		mode = content.mode
+	}
+
+	metadata, body, err := b.packContent(header, tmp, size, mode)
+	if err != nil {
+		return err
+	}
+	format := aws.StringValue(metadata[formatMetadata])
+
+	err = b.storeObject(key, hash, metadata, body, size, file)
+	if err != nil {
+		return err
+	}
+
+	repackedSize, err := body.Seek(0, io.SeekEnd)
+	if err != nil {
+		return errors.Wrap(err, "failed to read object size")
+	}
+
+	log.Printf("Repacked %q from %s (%d bytes) to %s (%d bytes)",
+		key, content.format, storedSize, format, repackedSize)
+	return b.verifyPut(key, hash, file)
+}
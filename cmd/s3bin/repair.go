@@ -0,0 +1,118 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Repair verifies the object of every file recorded under root, and
+// re-uploads the local file for objects that are missing or fail
+// verification. A file is only re-uploaded if it still hashes to the
+// recorded hash; objects that cannot be repaired are reported, and make
+// Repair fail once every file has been checked.
+func (b *s3Bin) Repair(root string) error {
+	unrepaired := 0
+	repair := func(file, hash string) error {
+		ok, err := b.repairFile(file, hash)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			unrepaired++
+		}
+		return nil
+	}
+
+	var err error
+	if b.lockFile != "" {
+		err = b.forEachLocked(root, repair)
+	} else {
+		err = filepath.Walk(
+			root, func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+
+				if info.IsDir() || filepath.Ext(path) != ".sha1" {
+					return nil
+				}
+
+				hash, err := b.readSidecar(path)
+				if err != nil {
+					return err
+				}
+
+				return repair(strings.TrimSuffix(path, ".sha1"), hash)
+			})
+	}
+	if err != nil {
+		return err
+	}
+
+	if unrepaired > 0 {
+		return errors.Errorf("%d objects could not be repaired", unrepaired)
+	}
+
+	return nil
+}
+
+// healObject uploads file, which is known to have the given hash, if the
+// object for hash is missing. It returns whether it did.
+func (b *s3Bin) healObject(file, hash string) (bool, error) {
+	exists, err := b.objectExists(hash)
+	if err != nil || exists {
+		return false, err
+	}
+
+	log.Printf("Object for %q is missing; uploading it from the local file", file)
+	_, err = b.putFile(file, hash)
+	if err != nil {
+		b.summary.add(file, hash, resultFailed, err)
+		return false, err
+	}
+
+	b.summary.add(file, hash, resultRepaired, nil)
+	return true, nil
+}
+
+// repairFile verifies the object for hash, and re-uploads file if the
+// object fails verification. It returns false if the object is broken and
+// file cannot replace it.
+func (b *s3Bin) repairFile(file, hash string) (bool, error) {
+	ctx, cancel := b.objectContext()
+	defer cancel()
+
+	verifyErr := b.verifyObject(ctx, hash)
+	if verifyErr == nil {
+		b.summary.add(file, hash, resultVerified, nil)
+		return true, nil
+	}
+
+	log.Printf("Object for %q failed verification: %v", file, verifyErr)
+
+	localHash, err := calcSha1(file, b.ioBufferSize)
+	if err != nil {
+		log.Printf("Cannot repair %q: %v", file, err)
+		b.summary.add(file, hash, resultUnrepairable, verifyErr)
+		return false, nil
+	}
+	if localHash != hash {
+		log.Printf("Cannot repair %q: file has hash %s, expected %s",
+			file, localHash, hash)
+		b.summary.add(file, hash, resultUnrepairable, verifyErr)
+		return false, nil
+	}
+
+	log.Printf("Repairing %q", file)
+	_, err = b.putFile(file, hash)
+	if err != nil {
+		return false, err
+	}
+
+	b.summary.add(file, hash, resultRepaired, verifyErr)
+	return true, nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// resumeManifest records the files restored by GetDir, so that an
+// interrupted run can skip them when restarted. The manifest is a file of
+// JSON lines which is only ever appended to and flushed after each record,
+// so a crash can at worst leave a truncated last line, which is ignored.
+type resumeManifest struct {
+	mu   sync.Mutex
+	f    *os.File
+	done map[string]manifestEntry
+}
+
+type manifestEntry struct {
+	Path    string `json:"path"`
+	Hash    string `json:"hash"`
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mtime"`
+}
+
+func openResumeManifest(path string) (*resumeManifest, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open resume manifest %q", path)
+	}
+
+	m := &resumeManifest{
+		f:    f,
+		done: make(map[string]manifestEntry),
+	}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry manifestEntry
+		if json.Unmarshal(scanner.Bytes(), &entry) != nil {
+			// Most likely a partial record from an interrupted run.
+			continue
+		}
+		m.done[entry.Path] = entry
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, errors.Wrapf(err, "failed to read resume manifest %q", path)
+	}
+
+	return m, nil
+}
+
+func (m *resumeManifest) Close() error {
+	return m.f.Close()
+}
+
+// isDone returns true if targetFile was recorded as restored with the given
+// hash, and its size and modification time still match the record. These
+// can match for a file that was rewritten, e.g. with its modification time
+// restored, so GetDir also checks the file's hash before skipping it.
+func (m *resumeManifest) isDone(targetFile, hash string) bool {
+	absPath, err := filepath.Abs(targetFile)
+	if err != nil {
+		return false
+	}
+
+	m.mu.Lock()
+	entry, ok := m.done[absPath]
+	m.mu.Unlock()
+
+	if !ok || entry.Hash != hash {
+		return false
+	}
+
+	fstat, err := os.Stat(targetFile)
+	if err != nil {
+		return false
+	}
+
+	return fstat.Size() == entry.Size && fstat.ModTime().UnixNano() == entry.ModTime
+}
+
+// record appends targetFile to the manifest, and flushes it to disk.
+func (m *resumeManifest) record(targetFile, hash string) error {
+	absPath, err := filepath.Abs(targetFile)
+	if err != nil {
+		return errors.Wrapf(err, "failed to resolve %q", targetFile)
+	}
+
+	fstat, err := os.Stat(targetFile)
+	if err != nil {
+		return errors.Wrap(err, "failed to read file attributes")
+	}
+
+	entry := manifestEntry{
+		Path:    absPath,
+		Hash:    hash,
+		Size:    fstat.Size(),
+		ModTime: fstat.ModTime().UnixNano(),
+	}
+
+	line, err := json.Marshal(&entry)
+	if err != nil {
+		return errors.Wrap(err, "json.Marshal(entry)")
+	}
+	line = append(line, '\n')
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, err = m.f.Write(line)
+	if err != nil {
+		return errors.Wrap(err, "failed to write resume manifest")
+	}
+
+	err = m.f.Sync()
+	if err != nil {
+		return errors.Wrap(err, "failed to flush resume manifest")
+	}
+
+	m.done[absPath] = entry
+	return nil
+}
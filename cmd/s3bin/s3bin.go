@@ -8,6 +8,10 @@ SHA1 hash of the uploaded binary.
 With the -get flag, s3bin takes the sha1 file created by -put and downloads
 the corresponding file from S3 iff the corresponding local file dos not exist
 or its contents do not match the provided hash.
+
+With the -lock-file flag, hashes are recorded in and read from a single JSON
+lock file instead of .sha1 files. -get then takes the file itself, and
+-get-dir downloads every file in the lock file under the directory.
 */
 package main
 
@@ -15,7 +19,10 @@ import (
 	"archive/tar"
 	"bytes"
 	"compress/gzip"
+	"context"
+	"crypto/md5"
 	"crypto/sha1"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"flag"
@@ -25,9 +32,16 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/pkg/errors"
@@ -35,265 +49,1688 @@ import (
 
 const version = 1
 
+// errObjectTimeout is the cause of errors for transfers that did not finish
+// within -per-object-timeout.
+var errObjectTimeout = errors.New("transfer timed out")
+
 type Header struct {
 	Version int `json:"version"`
+
+	// XAttrs are the extended attributes of the file, if they were
+	// captured with -preserve-xattr.
+	XAttrs map[string][]byte `json:"xattrs,omitempty"`
+
+	// Caps are the Linux file capabilities of the file, in the form of
+	// the security.capability extended attribute, if they were captured
+	// with -preserve-caps.
+	Caps []byte `json:"caps,omitempty"`
+
+	// Name is the base name of the file the object was put from, if it
+	// was recorded with -record-name. It is advisory: files with the same
+	// content share an object, and the name is that of the last one put.
+	Name string `json:"name,omitempty"`
+
+	// Codec and Level are the compression codec, and its level, chosen for
+	// the object by -compress auto-best. They are informational: the
+	// object's format says how to read it.
+	Codec string `json:"codec,omitempty"`
+	Level int    `json:"level,omitempty"`
 }
 
 type s3Bin struct {
 	s3Bucket string
+	sess     *session.Session
 	s3Cli    *s3.S3
+
+	// bucketRegion is the bucket's region, as last reported by a region
+	// redirect.
+	bucketRegion atomic.Value
+
+	// prefix is prepended to the keys of stored objects.
+	prefix string
+
+	// keyPrefixBytes is the number of hex digits of the hash in the first
+	// segment of object keys, as recorded in the prefix's key layout.
+	keyPrefixBytes int
+
+	// keyTemplate, if set, derives the keys of objects from their hashes
+	// instead of storeKey, as recorded in the prefix's key layout.
+	// keyTemplateText is its text.
+	keyTemplate     *template.Template
+	keyTemplateText string
+
+	// layoutOnce reads the prefix's key layout, and sets up the fields
+	// above, before the first key is derived; layoutErr is the error that
+	// failed with. See loadKeyLayout.
+	layoutOnce sync.Once
+	layoutErr  error
+
+	// lockFile, if set, is the path of the lock file used to record hashes
+	// instead of .sha1 files.
+	lockFile string
+	lockMu   sync.Mutex
+
+	// requireSidecars makes GetDir fail if it finds no files to download,
+	// and requireAllSidecars, if it finds files without .sha1 files.
+	requireSidecars    bool
+	requireAllSidecars bool
+
+	// resumeManifest, if set, is the path of the manifest GetDir uses to
+	// record and skip files that were already restored.
+	resumeManifest string
+
+	// checkFreeSpace makes GetDir check that there is room for the files
+	// it downloads before it starts.
+	checkFreeSpace bool
+
+	// hashWorkers is the number of local files GetDir hashes at once.
+	hashWorkers int
+
+	// concurrency is the number of objects checked at once by -list-orphans
+	// and -check-space.
+	concurrency int
+
+	// cacheDir, if set, is the -cache-dir directory.
+	cacheDir string
+
+	// resumableUploads makes large objects be uploaded in parts, in a way
+	// that can be resumed after a failure. See multipart.go.
+	resumableUploads bool
+
+	// quota, if set, limits the objects stored under the prefix.
+	quota *prefixQuota
+
+	// statCache, if set, caches the hashes of local files checked by -get
+	// and -get-dir.
+	statCache *statCache
+
+	// versionID, if set, is the version of the object read by -get, -stat,
+	// -dump-object and -presign.
+	versionID *string
+
+	// requestPayer is set to "requester" to read from requester-pays
+	// buckets.
+	requestPayer *string
+
+	// verifyAfterPut makes Put download and check each object after it is
+	// uploaded, and before its hash is recorded. If verifyCleanup is also
+	// set, objects that fail verification are deleted.
+	verifyAfterPut bool
+	verifyCleanup  bool
+
+	// objectLockMode and objectLockUntil, if set, are the object lock
+	// retention settings applied to uploaded objects.
+	objectLockMode  *string
+	objectLockUntil *time.Time
+
+	// autoTierThreshold, if set, is the content size from which uploaded
+	// objects are stored in the INTELLIGENT_TIERING storage class.
+	autoTierThreshold int64
+
+	// acl, if set, is the canned ACL applied to uploaded objects.
+	acl *string
+
+	// s3Checksum, if set, is the S3 checksum algorithm used to have S3
+	// validate uploaded objects. It also makes Get validate the checksums S3
+	// returns for downloaded objects.
+	s3Checksum string
+
+	// strictKey makes Get check that downloaded content matches the hash
+	// it is stored under.
+	strictKey bool
+
+	// mismatchRetries is the number of times Get downloads content again
+	// if it does not match its hash. Content is checked if it is set.
+	mismatchRetries int
+
+	// onDownload, if set, is the command run for every downloaded file.
+	onDownload string
+
+	// raw makes Put store file contents as-is, without the gzipped tar
+	// wrapper and its header.
+	raw bool
+
+	// preserveXattr makes Put store the extended attributes of files, and
+	// Get restore them.
+	preserveXattr bool
+
+	// preserveCaps makes Put store the file capabilities of files, and Get
+	// restore them.
+	preserveCaps bool
+
+	// since makes GetDir skip .sha1 files last modified before it.
+	since time.Time
+
+	// checkSidecarPerms makes Get refuse .sha1 files, and lock files, that
+	// are writable by their group or others.
+	checkSidecarPerms bool
+
+	// skipUnchanged makes Put skip files whose recorded hash is current
+	// and stored.
+	skipUnchanged bool
+
+	// hardlinkDedup makes GetDir restore files with the same content as
+	// one restored before it as hard links to it.
+	hardlinkDedup bool
+
+	// summary, if set, collects the results of files for -summary-out.
+	summary *summary
+
+	// preferNewer makes Get keep local files that do not match their hash
+	// if they are newer than the object.
+	preferNewer bool
+
+	// missingOnly makes Get take local files that exist to be up-to-date,
+	// without hashing them.
+	missingOnly bool
+
+	// heal makes Get upload local files that match their hash when their
+	// object is missing.
+	heal bool
+
+	// stripPathPrefix and addPathPrefix relocate the files restored by
+	// GetDir: stripPathPrefix is removed from the path implied by each .sha1
+	// file, and addPathPrefix is prepended to the result.
+	stripPathPrefix string
+	addPathPrefix   string
+
+	// relativeRoot, if set, is the -relative-root directory that JSON .sha1
+	// files record the paths of their files relative to.
+	relativeRoot string
+
+	// gzipOnly makes Put store files in the gzip format.
+	gzipOnly bool
+
+	// autoBest makes Put store each file in whichever of the formats and
+	// compression levels yields the smallest object, and record the choice
+	// in its header. Files larger than autoBestMaxSize are stored in the
+	// default format.
+	autoBest        bool
+	autoBestMaxSize int64
+
+	// strictFormat rejects objects that do not match their format exactly.
+	strictFormat bool
+
+	// chunked makes Put store files as chunked objects.
+	chunked bool
+
+	// paranoid makes chunked puts compare chunks that are already stored
+	// with their content, instead of trusting their hashes.
+	paranoid bool
+
+	// deleteSourceFile makes Put remove files once they are stored.
+	deleteSourceFile bool
+
+	// noSidecar makes Put print the hash to stdout instead of recording it.
+	noSidecar bool
+
+	// sidecarFormat is the format of the .sha1 files written by Put. Get
+	// reads either format.
+	sidecarFormat string
+
+	// gitignore makes Put add the files it puts to the nearest .gitignore.
+	gitignore bool
+
+	// normalizeMode, if set, is the mode stored with every file put, and
+	// normalizeExec stores 0755 for executable files and 0644 otherwise.
+	normalizeMode *os.FileMode
+	normalizeExec bool
+
+	// recordName records the base name of files put in their header.
+	recordName bool
+
+	// limiter, if set, caps the combined bandwidth of all transfers.
+	limiter *bandwidthLimiter
+
+	// inflight, if set, caps the combined size of the objects copied at
+	// once by Mirror, the only mode that transfers objects concurrently.
+	inflight *inflightLimit
+
+	// tarFormat is the format of the tar headers of tar.gz objects.
+	tarFormat tar.Format
+
+	// ioBufferSize, if set, is the size of the buffer file content is
+	// copied through when hashed, packed and downloaded.
+	ioBufferSize int
+
+	// heartbeatInterval, if set, is how often transfers log that they are
+	// still going.
+	heartbeatInterval time.Duration
+
+	// progressJSON, if set, makes transfers report their progress to
+	// stderr as lines of JSON.
+	progressJSON bool
+
+	// transferred counts the bytes of all request and response bodies.
+	transferred int64
+
+	// perObjectTimeout, if set, bounds the transfer of each object.
+	perObjectTimeout time.Duration
+
+	// attemptTimeout, if set, bounds each attempt of an S3 request.
+	attemptTimeout time.Duration
+
+	// explain makes S3 requests be logged, and those that write to S3 be
+	// skipped, as are the .sha1 files that would record them.
+	explain bool
+
+	stats Stats
 }
 
 func newS3Bin(region, bucket string) (*s3Bin, error) {
-	sess, err := session.NewSession()
+	// Enabling shared config lets credentials come from profiles in
+	// ~/.aws/config, such as those assuming a role with a web identity
+	// token. AWS_WEB_IDENTITY_TOKEN_FILE and AWS_ROLE_ARN, as set up by EKS
+	// for IAM roles for service accounts, are honored regardless. The region
+	// is also given to the session, as STS needs one to assume the role.
+	//
+	// If region is empty, the session falls back to AWS_REGION, then
+	// AWS_DEFAULT_REGION, then the region of the profile in ~/.aws/config,
+	// any of which may be empty too.
+	config := aws.Config{}
+	if region != "" {
+		config.Region = aws.String(region)
+	}
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            config,
+		SharedConfigState: session.SharedConfigEnable,
+	})
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to create AWS session")
 	}
+	region = aws.StringValue(sess.Config.Region)
+
+	b := &s3Bin{
+		s3Bucket: bucket,
+		sess:     sess,
+	}
+
+	b.setRegion(region)
+	return b, nil
+}
 
-	s3Cli := s3.New(sess, &aws.Config{
+// setRegion replaces the S3 client with one for region.
+func (b *s3Bin) setRegion(region string) {
+	b.s3Cli = s3.New(b.sess, &aws.Config{
 		Region: aws.String(region),
 	})
 
-	return &s3Bin{
-		s3Bucket: bucket,
-		s3Cli:    s3Cli,
-	}, nil
+	b.s3Cli.Handlers.Send.PushBack(func(*request.Request) {
+		atomic.AddInt64(&b.stats.S3Calls, 1)
+	})
+	b.s3Cli.Handlers.UnmarshalError.PushFront(b.recordBucketRegion)
+	b.s3Cli.Handlers.Send.PushFront(b.countRequestBody)
+	b.s3Cli.Handlers.Send.PushBack(b.countResponseBody)
+
+	if b.limiter != nil {
+		b.s3Cli.Handlers.Send.PushFront(b.limiter.throttle)
+		b.s3Cli.Handlers.Send.PushBack(b.limiter.throttleResponse)
+	}
+
+	if b.attemptTimeout > 0 {
+		b.s3Cli.Handlers.Send.PushFront(b.startAttempt)
+		b.s3Cli.Handlers.Send.PushBack(b.endAttempt)
+	}
+
+	if b.explain {
+		b.s3Cli.Handlers.Sign.PushBack(b.explainRequest)
+	}
+
+	if b.progressJSON {
+		b.s3Cli.Handlers.Send.PushFront(b.trackProgress)
+	}
+}
+
+// setMaxBandwidth caps the combined bandwidth of all transfers.
+func (b *s3Bin) setMaxBandwidth(bytesPerSecond int64) {
+	b.limiter = newBandwidthLimiter(bytesPerSecond)
+	b.setRegion(aws.StringValue(b.s3Cli.Config.Region))
+}
+
+// objectContext returns the context for the transfer of a single object,
+// which is bounded by -per-object-timeout.
+func (b *s3Bin) objectContext() (context.Context, context.CancelFunc) {
+	if b.perObjectTimeout > 0 {
+		return context.WithTimeout(context.Background(), b.perObjectTimeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// getObject starts downloading the object with the given key. ctx bounds
+// the whole download, including reading the response body.
+func (b *s3Bin) getObject(ctx context.Context, key string) (*s3.GetObjectOutput, error) {
+	return b.getObjectVersion(ctx, key, nil)
+}
+
+// getObjectVersion is getObject for the given version of the object, or if
+// versionID is nil, its current version.
+func (b *s3Bin) getObjectVersion(ctx context.Context, key string, versionID *string) (*s3.GetObjectOutput, error) {
+	return b.getObjectRange(ctx, key, versionID, "")
+}
+
+// getObjectRange is getObjectVersion for the byte range rng of the object,
+// in the form of an HTTP Range header, or if rng is empty, all of it. S3
+// checksums cover whole objects, so they are not checked for ranges.
+func (b *s3Bin) getObjectRange(ctx context.Context, key string, versionID *string, rng string) (*s3.GetObjectOutput, error) {
+	input := &s3.GetObjectInput{
+		Bucket:       aws.String(b.s3Bucket),
+		Key:          aws.String(key),
+		RequestPayer: b.requestPayer,
+		VersionId:    versionID,
+	}
+
+	if rng != "" {
+		input.Range = aws.String(rng)
+	}
+
+	checkSum := b.s3Checksum != "" && rng == ""
+	if checkSum {
+		input.ChecksumMode = aws.String(s3.ChecksumModeEnabled)
+	}
+
+	res, err := b.s3Cli.GetObjectWithContext(ctx, input)
+	if isNotFound(err) {
+		return nil, errors.Wrapf(ErrObjectNotFound, "failed to read %q from S3 bucket %q",
+			key, b.s3Bucket)
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %q from S3 bucket %q",
+			key, b.s3Bucket)
+	}
+
+	res.Body = &countingReadCloser{
+		ReadCloser: res.Body,
+		n:          &b.stats.BytesDownloaded,
+	}
+
+	if checkSum {
+		res.Body = newChecksumReadCloser(res, key)
+	}
+
+	return res, nil
 }
 
 func (b *s3Bin) Put(path string) error {
-	hash, err := calcSha1(path)
+	if b.skipUnchanged {
+		// Files that are unchanged are likely to be in the stat cache. The
+		// cached hash only decides whether to skip the file: an object is
+		// never uploaded under it, in case the cache is stale.
+		cached, err := b.localHash(path)
+		if err != nil {
+			return err
+		}
+		unchanged, err := b.isUnchanged(path, cached)
+		if err != nil {
+			return err
+		}
+		if unchanged {
+			log.Printf("%q is unchanged", path)
+			atomic.AddInt64(&b.stats.FilesSkipped, 1)
+			b.summary.add(path, cached, resultSkipped, nil)
+			return nil
+		}
+	}
+
+	hash, err := calcSha1(path, b.ioBufferSize)
 	if err != nil {
 		return err
 	}
 
-	f, err := os.Open(path)
+	stop := b.heartbeat(path)
+	size, err := b.putFile(path, hash)
+	stop()
 	if err != nil {
-		return errors.Wrap(err, "failed to open file")
+		return err
 	}
-	defer f.Close()
 
-	fstat, err := f.Stat()
+	err = b.recordHash(path, hash, size)
 	if err != nil {
-		return errors.Wrap(err, "failed to read file attributes")
+		return err
 	}
+	b.summary.add(path, hash, resultUploaded, nil)
 
-	header := &Header{
-		Version: version,
+	if b.gitignore {
+		err = ignoreFile(path)
+		if err != nil {
+			return err
+		}
 	}
 
-	headerBytes, err := json.Marshal(header)
+	return b.deleteSource(path)
+}
+
+// deleteSource removes the file put from path if -delete-source is set. It
+// must only be called once the file is stored, verified and its hash
+// recorded.
+func (b *s3Bin) deleteSource(path string) error {
+	if !b.deleteSourceFile {
+		return nil
+	}
+
+	err := os.Remove(path)
 	if err != nil {
-		return errors.Wrap(err, "json.Marshal(header)")
+		return errors.Wrapf(err, "failed to delete %q", path)
 	}
 
-	gzippedBuf := &bytes.Buffer{}
-	gzipWriter := gzip.NewWriter(gzippedBuf)
-	tarWriter := tar.NewWriter(gzipWriter)
+	log.Printf("Deleted %q", path)
+	return nil
+}
 
-	err = tarWriter.WriteHeader(&tar.Header{
-		Name: "header",
-		Mode: 0600,
-		Size: int64(len(headerBytes)),
-	})
+// recordHash records the hash of the file put from path: in its .sha1 file,
+// in the lock file, or with -no-sidecar, by printing it.
+func (b *s3Bin) recordHash(path, hash string, size int64) error {
+	if b.explain {
+		log.Printf("Explain: %s recorded for %q, not written", hash, path)
+		return nil
+	}
+
+	if b.noSidecar {
+		fmt.Println(hash)
+		return nil
+	}
+
+	if b.lockFile != "" {
+		return b.updateLockFile(path, hash, size)
+	}
+
+	hashFile := path + ".sha1"
+
+	data, err := b.formatSidecar(path, hash, size)
 	if err != nil {
-		return errors.Wrap(err, "tarWriter.WriteHeader(header)")
+		return errors.Wrap(err, "failed to format hash file")
 	}
 
-	_, err = tarWriter.Write(headerBytes)
+	err = ioutil.WriteFile(hashFile, data, 0644)
 	if err != nil {
-		return errors.Wrap(err, "tarWriter.Write(header)")
+		return errors.Wrapf(err, "failed to create hash file %q", hashFile)
 	}
 
-	err = tarWriter.WriteHeader(&tar.Header{
-		Name: "data",
-		Mode: int64(fstat.Mode()),
-		Size: int64(fstat.Size()),
-	})
+	return nil
+}
 
+// putFile uploads the file at path, whose content has the given hash, and
+// returns its size.
+func (b *s3Bin) putFile(path, hash string) (int64, error) {
+	f, err := os.Open(path)
 	if err != nil {
-		return errors.Wrap(err, "tarWriter.WriteHeader")
+		return 0, errors.Wrap(err, "failed to open file")
 	}
+	defer f.Close()
 
-	_, err = io.Copy(tarWriter, f)
+	fstat, err := f.Stat()
 	if err != nil {
-		return errors.Wrap(err, "failed to read file")
+		return 0, errors.Wrap(err, "failed to read file attributes")
 	}
-	tarWriter.Close()
-	gzipWriter.Close()
 
-	_, err = b.s3Cli.PutObject(&s3.PutObjectInput{
-		Bucket: aws.String(b.s3Bucket),
-		Key:    aws.String(storeKey(hash)),
-		Body:   bytes.NewReader(gzippedBuf.Bytes()),
-	})
+	header, err := b.fileHeader(path)
 	if err != nil {
-		return errors.Wrap(err, "failed to write file in s3")
+		return 0, err
 	}
 
-	hashFile := path + ".sha1"
-
-	err = ioutil.WriteFile(hashFile, []byte(hash), 0644)
+	if b.chunked {
+		err = b.putChunked(hash, header, f, fstat.Size(), b.fileMode(fstat), path)
+	} else {
+		err = b.putObject(hash, header, f, fstat.Size(), b.fileMode(fstat), path)
+	}
 	if err != nil {
-		return errors.Wrapf(err, "failed to create hash file %q", hashFile)
+		return 0, err
 	}
 
-	return nil
+	return fstat.Size(), nil
 }
 
-func (b *s3Bin) Get(sha1File string) error {
-	targetFile := strings.TrimSuffix(sha1File, ".sha1")
-	if targetFile == sha1File {
-		return errors.New("SHA1 file doesn't have .sha1 extension")
+// fileMode returns the mode stored with the file described by fstat. With
+// -normalize-mode, it is a canonical mode rather than the file's own, so
+// that the same file is stored the same way whatever the umask it was
+// created under.
+func (b *s3Bin) fileMode(fstat os.FileInfo) os.FileMode {
+	if b.normalizeMode != nil {
+		return *b.normalizeMode
+	}
+	if b.normalizeExec {
+		if fstat.Mode()&0111 != 0 {
+			return 0755
+		}
+		return 0644
 	}
+	return fstat.Mode()
+}
 
-	sha1Bytes, err := ioutil.ReadFile(sha1File)
-	if err != nil {
-		return errors.Wrapf(err, "failed to read sha1 file %q", sha1File)
+// fileHeader returns the header stored with the file put from path.
+func (b *s3Bin) fileHeader(path string) (*Header, error) {
+	header := &Header{
+		Version: version,
 	}
 
-	sha1Str := strings.ToLower(strings.TrimSpace(string(sha1Bytes)))
-	if len(sha1Str) != 40 {
-		return errors.Wrapf(err, "sha1 file %q is invalid", sha1File)
+	if b.recordName {
+		header.Name = filepath.Base(path)
 	}
 
-	existingHash, err := calcSha1(targetFile)
-	if err == nil {
-		if existingHash == sha1Str {
-			log.Printf("%q exists and is up-to-date", targetFile)
-			return nil
-		} else {
-			log.Printf("Updating %q", targetFile)
+	if b.preserveXattr {
+		var err error
+		header.XAttrs, err = readXattrs(path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read extended attributes of %q", path)
 		}
-	} else if os.IsNotExist(errors.Cause(err)) {
-		log.Printf("Downloading %q", targetFile)
-	} else {
-		return err
 	}
 
-	key := storeKey(sha1Str)
+	if b.preserveCaps {
+		var err error
+		header.Caps, err = readCaps(path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read file capabilities of %q", path)
+		}
 
-	res, err := b.s3Cli.GetObject(&s3.GetObjectInput{
-		Bucket: aws.String(b.s3Bucket),
-		Key:    aws.String(key),
-	})
+		// Capabilities are restored on their own, and only with
+		// -preserve-caps.
+		delete(header.XAttrs, capabilityXattr)
+	}
+
+	return header, nil
+}
 
+// PutReader uploads the contents of r, and returns their hash. Unlike Put,
+// it does not record the hash anywhere; that is left to the caller. name is
+// only used to identify the content in errors.
+//
+// The size of the content must be known before it can be archived, so r is
+// first copied to a temporary file while it is hashed. As with Put, the
+// compressed archive is then built in memory before it is uploaded.
+func (b *s3Bin) PutReader(r io.Reader, name string, mode os.FileMode) (string, error) {
+	tmp, err := ioutil.TempFile("", "s3bin-")
 	if err != nil {
-		return errors.Wrapf(err, "failed to read %q from S3 bucket %q",
-			key, b.s3Bucket)
+		return "", errors.Wrap(err, "failed to create temporary file")
 	}
-	defer res.Body.Close()
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
 
-	gzipReader, err := gzip.NewReader(res.Body)
+	hash := sha1.New()
+	size, err := copyBuffer(io.MultiWriter(tmp, hash), r, b.ioBufferSize)
 	if err != nil {
-		return errors.Wrap(err, "failed to create gzip reader")
+		return "", errors.Wrapf(err, "failed to read %q", name)
 	}
 
-	tarReader := tar.NewReader(gzipReader)
-	tarHdr, err := tarReader.Next()
+	_, err = tmp.Seek(0, io.SeekStart)
 	if err != nil {
-		return errors.Wrap(err, "tarReader.Next")
+		return "", errors.Wrap(err, "failed to rewind temporary file")
 	}
 
-	if tarHdr.Name != "header" {
-		return errors.New("tar does not have 'header'")
-	}
+	hashStr := hex.EncodeToString(hash.Sum(nil))
 
-	headerBytes, err := ioutil.ReadAll(tarReader)
+	err = b.putObject(hashStr, &Header{Version: version}, tmp, size, mode, name)
 	if err != nil {
-		return errors.Wrap(err, "failed to read header")
+		return "", err
 	}
 
-	var header Header
-	err = json.Unmarshal(headerBytes, &header)
+	return hashStr, nil
+}
+
+// putObject uploads size bytes of content read from r as the object for
+// hash. header is stored with the content, unless the object is raw.
+func (b *s3Bin) putObject(hash string, header *Header, r io.ReadSeeker, size int64, mode os.FileMode, name string) error {
+	key, err := b.objectKey(hash)
 	if err != nil {
-		return errors.Wrap(err, "json.Unmarshal")
+		return err
 	}
+	return b.putObjectAt(key, hash, header, r, size, mode, name)
+}
 
-	if header.Version != version {
-		return errors.Wrapf(err, "unsupported version %d", header.Version)
+// putObjectAt is putObject for an object stored under key.
+func (b *s3Bin) putObjectAt(key, hash string, header *Header, r io.ReadSeeker, size int64, mode os.FileMode, name string) error {
+	metadata, body, err := b.packContent(header, r, size, mode)
+	if err != nil {
+		return err
 	}
 
-	tarHdr, err = tarReader.Next()
+	err = b.storeObject(key, hash, metadata, body, size, name)
 	if err != nil {
-		return errors.Wrap(err, "tarReader.Next")
+		return err
 	}
 
-	if tarHdr.Name != "data" {
-		return errors.Errorf("tar does not have 'data'")
+	atomic.AddInt64(&b.stats.FilesUploaded, 1)
+	return b.verifyPut(key, hash, name)
+}
+
+// packContent returns the body of the object for size bytes of content
+// read from r, and its metadata, which records the format it is in.
+func (b *s3Bin) packContent(header *Header, r io.ReadSeeker, size int64, mode os.FileMode) (map[string]*string, io.ReadSeeker, error) {
+	if b.raw {
+		return formatOnly(formatRaw), r, nil
 	}
 
-	f, err := os.Create(targetFile)
-	if err != nil {
-		return errors.Wrapf(err, "failed to create target file %q", targetFile)
+	if b.gzipOnly {
+		return packGzip(header, r, size, mode, b.ioBufferSize)
 	}
-	defer f.Close()
 
-	_, err = io.Copy(f, tarReader)
+	if b.autoBest {
+		return b.packBest(header, r, size, mode)
+	}
+
+	archive, err := b.packObject(header, r, size, mode)
 	if err != nil {
-		return errors.Wrapf(err, "failed to copy file")
+		return nil, nil, err
+	}
+	return formatOnly(formatTarGz), bytes.NewReader(archive), nil
+}
+
+// storeObject uploads body, an object with size bytes of content of the
+// given hash, under key. metadata must record the object's format.
+func (b *s3Bin) storeObject(key, hash string, metadata map[string]*string, body io.ReadSeeker, size int64, name string) error {
+	metadata[hashMetadata] = aws.String(hash)
+
+	input := &s3.PutObjectInput{
+		Bucket:       aws.String(b.s3Bucket),
+		Key:          aws.String(key),
+		Body:         body,
+		Metadata:     metadata,
+		StorageClass: b.storageClass(size),
+	}
+
+	if b.acl != nil {
+		input.ACL = b.acl
 	}
 
-	err = f.Chmod(os.FileMode(tarHdr.Mode))
+	bodySize, err := body.Seek(0, io.SeekEnd)
+	if err == nil {
+		_, err = body.Seek(0, io.SeekStart)
+	}
 	if err != nil {
-		return errors.Wrap(err, "failed to set file mode")
+		return errors.Wrap(err, "failed to read file size")
 	}
 
-	return nil
-}
+	// Parts of multipart uploads have checksums of their own.
+	multipart := b.resumableUploads && bodySize >= multipartThreshold
 
-func (b *s3Bin) GetDir(root string) error {
-	return filepath.Walk(
-		root, func(path string, info os.FileInfo, err error) error {
+	if b.s3Checksum != "" && !multipart {
+		err := setPutChecksum(input, b.s3Checksum)
+		if err != nil {
+			return err
+		}
+	}
+
+	if b.objectLockMode != nil {
+		// S3 requires Content-MD5 on uploads with a retention period.
+		if !multipart {
+			contentMD5, err := calcMD5(body)
 			if err != nil {
 				return err
 			}
+			input.ContentMD5 = aws.String(contentMD5)
+		}
+		input.ObjectLockMode = b.objectLockMode
+		input.ObjectLockRetainUntilDate = b.objectLockUntil
+	}
 
-			if info.IsDir() && path != root && info.Name() != "." && info.Name() != ".." {
-				return b.GetDir(path)
-			}
+	err = b.checkQuota(b.quota, key, bodySize)
+	if err != nil {
+		return err
+	}
 
-			if filepath.Ext(path) != ".sha1" {
-				return nil
-			}
+	ctx, cancel := b.objectContext()
+	defer cancel()
 
-			return b.Get(path)
-		})
-}
+	p, stop := b.startProgress(name, bodySize)
+	defer stop()
+	ctx = withProgress(ctx, p)
 
-func calcSha1(path string) (string, error) {
-	f, err := os.Open(path)
+	if multipart {
+		err = b.storeMultipart(ctx, input, bodySize)
+	} else {
+		_, err = b.s3Cli.PutObjectWithContext(ctx, input)
+	}
 	if err != nil {
-		return "", errors.Wrap(err, "failed to open file")
+		if ctx.Err() == context.DeadlineExceeded {
+			return errors.Wrapf(errObjectTimeout, "failed to upload %q after %v",
+				name, b.perObjectTimeout)
+		}
+		return errors.Wrap(b.explainLocked(key, err), "failed to write file in s3")
 	}
-	defer f.Close()
 
-	hash := sha1.New()
-	_, err = io.Copy(hash, f)
+	atomic.AddInt64(&b.stats.BytesUploaded, bodySize)
+	b.addUsage(b.quota, bodySize)
+	return nil
+}
+
+// verifyPut verifies the object just put under key if -verify-after-put is
+// set.
+func (b *s3Bin) verifyPut(key, hash, name string) error {
+	if !b.verifyAfterPut {
+		return nil
+	}
+
+	ctx, cancel := b.objectContext()
+	defer cancel()
+
+	err := b.verifyKey(ctx, key, hash)
 	if err != nil {
-		return "", errors.Wrap(err, "failed to read file")
+		if b.verifyCleanup {
+			if delErr := b.deleteKey(key); delErr != nil {
+				log.Print(delErr)
+			}
+		}
+		return errors.Wrapf(err, "verification of %q failed", name)
 	}
 
-	return strings.ToLower(hex.EncodeToString(hash.Sum(nil))), nil
+	return nil
 }
 
-func storeKey(hash string) string {
-	return fmt.Sprintf("%s/%s/%s/%s/%s",
-		hash[:4], hash[4:8], hash[8:12], hash[12:16], hash[16:20])
+func (b *s3Bin) packObject(header *Header, r io.Reader, size int64, mode os.FileMode) ([]byte, error) {
+	return b.packObjectLevel(header, r, size, mode, gzip.DefaultCompression)
 }
 
-func main() {
-	var (
+// parseTarFormat parses a -tar-format value. PAX, the default, writes the
+// same headers as USTAR for the members of objects, and can also represent
+// content of 8 GiB and more, which USTAR cannot.
+func parseTarFormat(s string) (tar.Format, bool) {
+	switch strings.ToLower(s) {
+	case "pax":
+		return tar.FormatPAX, true
+	case "gnu":
+		return tar.FormatGNU, true
+	case "ustar":
+		return tar.FormatUSTAR, true
+	}
+	return tar.FormatUnknown, false
+}
+
+// packObjectLevel is packObject with the given gzip compression level. The
+// tar headers are written in the -tar-format format.
+func (b *s3Bin) packObjectLevel(header *Header, r io.Reader, size int64, mode os.FileMode, level int) ([]byte, error) {
+	headerBytes, err := json.Marshal(header)
+	if err != nil {
+		return nil, errors.Wrap(err, "json.Marshal(header)")
+	}
+
+	gzippedBuf := &bytes.Buffer{}
+	gzipWriter, err := newGzipWriter(gzippedBuf, level)
+	if err != nil {
+		return nil, err
+	}
+	tarWriter := tar.NewWriter(gzipWriter)
+
+	err = tarWriter.WriteHeader(&tar.Header{
+		Name:   "header",
+		Mode:   0600,
+		Size:   int64(len(headerBytes)),
+		Format: b.tarFormat,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "tarWriter.WriteHeader(header)")
+	}
+
+	_, err = tarWriter.Write(headerBytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "tarWriter.Write(header)")
+	}
+
+	err = tarWriter.WriteHeader(&tar.Header{
+		Name:   "data",
+		Mode:   int64(mode),
+		Size:   size,
+		Format: b.tarFormat,
+	})
+
+	if err != nil {
+		return nil, errors.Wrap(err, "tarWriter.WriteHeader")
+	}
+
+	_, err = copyBuffer(tarWriter, r, b.ioBufferSize)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read file")
+	}
+	tarWriter.Close()
+	gzipWriter.Close()
+
+	return gzippedBuf.Bytes(), nil
+}
+
+func (b *s3Bin) Get(sha1File string) error {
+	if b.lockFile != "" {
+		return b.getLocked(sha1File)
+	}
+
+	targetFile := strings.TrimSuffix(sha1File, ".sha1")
+	if targetFile == sha1File {
+		return errors.Wrapf(ErrInvalidSidecar, "%q doesn't have .sha1 extension", sha1File)
+	}
+
+	sha1Str, err := b.readSidecar(sha1File)
+	if err != nil {
+		return err
+	}
+
+	return b.getFile(targetFile, sha1Str)
+}
+
+// GetHash downloads the file whose hash is read from r, in the format of a
+// .sha1 file, to targetFile.
+func (b *s3Bin) GetHash(r io.Reader, targetFile string) error {
+	data, err := ioutil.ReadAll(io.LimitReader(r, 4096))
+	if err != nil {
+		return errors.Wrap(err, "failed to read hash")
+	}
+
+	sha1Str := sidecarHash(string(data))
+	if !isValidHash(sha1Str) {
+		return errors.Errorf("%q is not a valid hash", strings.TrimSpace(string(data)))
+	}
+
+	return b.getFile(targetFile, sha1Str)
+}
+
+// getFile downloads the file with the given hash to targetFile, unless
+// targetFile already exists and has the same hash.
+func (b *s3Bin) getFile(targetFile, sha1Str string) error {
+	existingHash, err := b.existingHash(targetFile, sha1Str)
+	return b.updateFile(targetFile, sha1Str, existingHash, err)
+}
+
+// existingHash returns the hash of targetFile, the local copy of the file
+// with the given hash. With -missing-only, a file that exists is taken to
+// have that hash without reading it.
+func (b *s3Bin) existingHash(targetFile, sha1Str string) (string, error) {
+	if !b.missingOnly {
+		return b.localHash(targetFile)
+	}
+
+	_, err := os.Stat(targetFile)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to read file attributes")
+	}
+	return sha1Str, nil
+}
+
+// updateFile is getFile given the hash of targetFile, or the error hashing
+// it failed with.
+func (b *s3Bin) updateFile(targetFile, sha1Str, existingHash string, err error) error {
+	if err == nil {
+		if existingHash == sha1Str {
+			if b.heal {
+				healed, err := b.healObject(targetFile, sha1Str)
+				if err != nil || healed {
+					return err
+				}
+			}
+
+			log.Printf("%q exists and is up-to-date", targetFile)
+			atomic.AddInt64(&b.stats.FilesSkipped, 1)
+			b.summary.add(targetFile, sha1Str, resultSkipped, nil)
+			return nil
+		}
+
+		if b.preferNewer {
+			newer, err := b.objectIsNewer(targetFile, sha1Str)
+			if err != nil {
+				return err
+			}
+			if !newer {
+				log.Printf("Warning: %q does not match its .sha1 file, but is newer than its object; keeping it",
+					targetFile)
+				atomic.AddInt64(&b.stats.FilesSkipped, 1)
+				b.summary.add(targetFile, sha1Str, resultSkipped, nil)
+				return nil
+			}
+		}
+
+		log.Printf("Updating %q", targetFile)
+	} else if os.IsNotExist(errors.Cause(err)) {
+		log.Printf("Downloading %q", targetFile)
+	} else {
+		return err
+	}
+
+	// The object is known to be good by its key, so content that does not
+	// match it may have been corrupted on the way.
+	for retry := 0; ; retry++ {
+		err = b.fetchFile(targetFile, sha1Str)
+		if errors.Cause(err) != ErrHashMismatch || retry == b.mismatchRetries {
+			break
+		}
+		log.Printf("%v; retrying (%d of %d)", err, retry+1, b.mismatchRetries)
+	}
+	if errors.Cause(err) == ErrHashMismatch && b.mismatchRetries > 0 {
+		err = errors.Wrapf(err, "object is corrupt in S3 after %d retries", b.mismatchRetries)
+	}
+	if err != nil {
+		b.summary.add(targetFile, sha1Str, resultFailed, err)
+		return err
+	}
+
+	atomic.AddInt64(&b.stats.FilesDownloaded, 1)
+	b.summary.add(targetFile, sha1Str, resultDownloaded, nil)
+	return b.runDownloadHook(targetFile)
+}
+
+// fetchFile makes a single attempt at downloading the file with the given
+// hash to targetFile.
+func (b *s3Bin) fetchFile(targetFile, sha1Str string) error {
+	ctx, cancel := b.objectContext()
+	defer cancel()
+
+	stop := b.heartbeat(targetFile)
+	err := b.downloadFile(ctx, targetFile, sha1Str)
+	stop()
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return errors.Wrapf(errObjectTimeout, "failed to download %q after %v",
+			targetFile, b.perObjectTimeout)
+	}
+	return err
+}
+
+// downloadFile downloads the file with the given hash to targetFile.
+func (b *s3Bin) downloadFile(ctx context.Context, targetFile, sha1Str string) error {
+	key, err := b.objectKey(sha1Str)
+	if err != nil {
+		return err
+	}
+
+	res, err := b.getObjectVersion(ctx, key, b.versionID)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	return b.saveObject(ctx, res, key, targetFile, sha1Str,
+		b.strictKey || b.mismatchRetries > 0)
+}
+
+// saveObject saves the content of res, the object downloaded from key, to
+// targetFile. With checkHash, the content must have the given hash.
+func (b *s3Bin) saveObject(ctx context.Context, res *s3.GetObjectOutput, key, targetFile, sha1Str string, checkHash bool) error {
+	content, err := b.openContent(ctx, res)
+	if err != nil {
+		return err
+	}
+
+	if chunks, ok := content.data.(*chunkReader); ok {
+		done, err := chunks.reuseLocal(targetFile)
+		if err != nil {
+			return err
+		}
+		defer done()
+	}
+
+	// The content is written to a temporary file, which then replaces
+	// targetFile. Writing targetFile in place would write through to the
+	// files hard-linked to it by -hardlink-dedup, and would leave a
+	// partial file behind if the download fails, e.g. when it times out.
+	f, err := ioutil.TempFile(filepath.Dir(targetFile), ".s3bin-")
+	if err != nil {
+		return errors.Wrapf(err, "failed to create temporary file for %q", targetFile)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	hash := sha1.New()
+	w := io.Writer(f)
+	if checkHash {
+		w = io.MultiWriter(f, hash)
+	}
+
+	p, stop := b.startProgress(targetFile, content.size)
+	defer stop()
+	if p != nil {
+		w = io.MultiWriter(w, p)
+	}
+
+	n, err := copyBuffer(w, content.data, b.ioBufferSize)
+	if err != nil {
+		return errors.Wrapf(err, "failed to copy file")
+	}
+
+	err = content.checkSize(n)
+	if err == nil {
+		err = content.finish()
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to download %q", key)
+	}
+
+	if checkHash {
+		actual := hex.EncodeToString(hash.Sum(nil))
+		if actual != sha1Str {
+			return errors.Wrapf(ErrHashMismatch, "object %q has hash %s, expected %s",
+				key, actual, sha1Str)
+		}
+	}
+
+	// The temporary file is only readable by its owner. Without a stored
+	// mode, the mode of the file it replaces is kept.
+	mode := os.FileMode(0644)
+	if content.hasMode {
+		mode = content.mode
+	} else if info, err := os.Stat(targetFile); err == nil {
+		mode = info.Mode().Perm()
+	}
+	err = f.Chmod(mode)
+	if err != nil {
+		return errors.Wrap(err, "failed to set file mode")
+	}
+
+	err = f.Close()
+	if err != nil {
+		return errors.Wrapf(err, "failed to write %q", targetFile)
+	}
+
+	err = os.Rename(f.Name(), targetFile)
+	if err != nil {
+		return errors.Wrapf(err, "failed to replace %q", targetFile)
+	}
+
+	if b.preserveXattr && content.header != nil && len(content.header.XAttrs) > 0 {
+		err = writeXattrs(targetFile, content.header.XAttrs)
+		if err != nil {
+			log.Printf("Failed to restore extended attributes of %q: %v", targetFile, err)
+		}
+	}
+
+	if b.preserveCaps && content.header != nil && len(content.header.Caps) > 0 {
+		err = writeCaps(targetFile, content.header.Caps)
+		if err != nil {
+			log.Printf("Failed to restore file capabilities of %q: %v", targetFile, err)
+		}
+	}
+
+	return nil
+}
+
+// openObject reads the header of a stored object from r, the object's
+// decompressed tar stream. It returns the header, and the tar header and
+// contents of the object's data member. With strict, the members must
+// match the format exactly; see checkStrictMember.
+func openObject(r io.Reader, strict bool) (*Header, *tar.Header, *tar.Reader, error) {
+	tarReader := tar.NewReader(r)
+	tarHdr, err := tarReader.Next()
+	if err != nil {
+		return nil, nil, nil, errors.Wrap(err, "tarReader.Next")
+	}
+
+	if tarHdr.Name != "header" {
+		return nil, nil, nil, errors.New("tar does not have 'header'")
+	}
+
+	if strict {
+		err = checkStrictMember(tarHdr, "header", 1)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	headerBytes, err := ioutil.ReadAll(tarReader)
+	if err != nil {
+		return nil, nil, nil, errors.Wrap(err, "failed to read header")
+	}
+
+	header := &Header{}
+	if strict {
+		err = decodeStrict(bytes.NewReader(headerBytes), header)
+	} else {
+		err = json.Unmarshal(headerBytes, header)
+	}
+	if err != nil {
+		return nil, nil, nil, errors.Wrap(err, "json.Unmarshal")
+	}
+
+	if header.Version != version {
+		return nil, nil, nil, errors.Errorf("unsupported version %d", header.Version)
+	}
+
+	tarHdr, err = tarReader.Next()
+	if err != nil {
+		return nil, nil, nil, errors.Wrap(err, "tarReader.Next")
+	}
+
+	if tarHdr.Name != "data" {
+		return nil, nil, nil, errors.Errorf("tar does not have 'data'")
+	}
+
+	if strict {
+		err = checkStrictMember(tarHdr, "data", 2)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	return header, tarHdr, tarReader, nil
+}
+
+func (b *s3Bin) GetDir(root string) error {
+	// The files are first found, and checked for being up-to-date in
+	// parallel. Only then is anything downloaded.
+	run := &getDirRun{}
+	if b.resumeManifest != "" {
+		var err error
+		run.manifest, err = openResumeManifest(b.resumeManifest)
+		if err != nil {
+			return err
+		}
+		defer run.manifest.Close()
+	}
+
+	var err error
+	if b.lockFile != "" {
+		err = b.walkLocked(root, run)
+	} else {
+		err = filepath.Walk(
+			root, func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+
+				if info.IsDir() {
+					return nil
+				}
+
+				if filepath.Ext(path) != ".sha1" {
+					if b.requireAllSidecars && info.Mode().IsRegular() {
+						return checkSidecar(path)
+					}
+					return nil
+				}
+
+				run.sidecars++
+				if info.ModTime().Before(b.since) {
+					return nil
+				}
+
+				sha1Str, err := b.readSidecar(path)
+				if err != nil {
+					return err
+				}
+
+				targetFile, err := b.sidecarTarget(path)
+				if err != nil {
+					return err
+				}
+
+				return b.queueDirFile(run, targetFile, sha1Str)
+			})
+	}
+	if err != nil {
+		return err
+	}
+
+	b.checkDirFiles(run)
+	if b.checkFreeSpace {
+		err = b.checkSpace(root, run.pending)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, file := range run.pending {
+		err = b.getDirFile(run, file)
+		if err != nil {
+			return err
+		}
+	}
+
+	if b.requireSidecars && run.sidecars == 0 {
+		if b.lockFile != "" {
+			return errors.Errorf("lock file %q has no files under %q", b.lockFile, root)
+		}
+		return errors.Errorf("found no .sha1 files in %q", root)
+	}
+
+	if run.failed > 0 {
+		return errors.Errorf("%d files failed to download", run.failed)
+	}
+
+	return nil
+}
+
+// getDirRun is the state of a single GetDir call.
+type getDirRun struct {
+	// manifest, if set, records the files already restored.
+	manifest *resumeManifest
+
+	// sidecars counts the files found to download, whether or not they
+	// were downloaded.
+	sidecars int
+
+	// failed counts the files that failed to download without stopping
+	// GetDir.
+	failed int
+
+	// pending are the files found to download, in the order they were
+	// found.
+	pending []*dirFile
+
+	// restored maps the hashes of files restored so far, or found
+	// up-to-date, to one of the files, for -hardlink-dedup.
+	restored map[string]string
+}
+
+// dirFile is a file found by GetDir.
+type dirFile struct {
+	target string
+	hash   string
+
+	// done is set if the run's manifest records the file as restored.
+	// Otherwise, localHash is the hash of the local file, or localErr the
+	// error hashing it failed with.
+	done      bool
+	localHash string
+	localErr  error
+}
+
+// queueDirFile adds a file for GetDir to download. The file is relocated
+// by -strip-path-prefix and -add-path-prefix.
+func (b *s3Bin) queueDirFile(run *getDirRun, targetFile, sha1Str string) error {
+	targetFile, err := b.remapTarget(targetFile)
+	if err != nil {
+		return err
+	}
+
+	run.pending = append(run.pending, &dirFile{target: targetFile, hash: sha1Str})
+	return nil
+}
+
+// checkDirFiles checks whether the files found by GetDir are up-to-date,
+// from up to -hash-workers goroutines at once. Hashing the local files is
+// most of the work of a GetDir that has nothing to download.
+func (b *s3Bin) checkDirFiles(run *getDirRun) {
+	files := make(chan *dirFile)
+	var wg sync.WaitGroup
+	for i := 0; i < b.hashWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for file := range files {
+				if run.manifest != nil && run.manifest.isDone(file.target, file.hash) {
+					// The hash check is quick for files in the stat cache.
+					hash, err := b.localHash(file.target)
+					if err == nil && hash == file.hash {
+						file.done = true
+						continue
+					}
+				}
+				file.localHash, file.localErr = b.existingHash(file.target, file.hash)
+			}
+		}()
+	}
+	for _, file := range run.pending {
+		files <- file
+	}
+	close(files)
+	wg.Wait()
+}
+
+// checkSidecar returns an error if the file at path has no .sha1 file.
+func checkSidecar(path string) error {
+	_, err := os.Stat(path + ".sha1")
+	if os.IsNotExist(err) {
+		return errors.Errorf("%q does not have a .sha1 file", path)
+	} else if err != nil {
+		return errors.Wrapf(err, "failed to check the .sha1 file of %q", path)
+	}
+	return nil
+}
+
+// getDirFile downloads a single file on behalf of GetDir, once it has been
+// checked by checkDirFiles, skipping it if the run's manifest records it as
+// already restored. Files that time out are reported and counted, and do not
+// stop GetDir.
+func (b *s3Bin) getDirFile(run *getDirRun, file *dirFile) error {
+	targetFile, sha1Str := file.target, file.hash
+	if file.done {
+		log.Printf("%q was already restored", targetFile)
+		atomic.AddInt64(&b.stats.FilesSkipped, 1)
+		b.summary.add(targetFile, sha1Str, resultSkipped, nil)
+		return nil
+	}
+
+	srcFile, ok := run.restored[sha1Str]
+	if ok && (file.localErr != nil || file.localHash != sha1Str) {
+		log.Printf("Linking %q to %q", targetFile, srcFile)
+		err := linkDuplicate(srcFile, targetFile)
+		if err != nil {
+			return err
+		}
+		b.summary.add(targetFile, sha1Str, resultLinked, nil)
+	} else {
+		err := b.updateFile(targetFile, sha1Str, file.localHash, file.localErr)
+		if errors.Cause(err) == errObjectTimeout {
+			log.Print(err)
+			run.failed++
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if b.hardlinkDedup && !ok {
+			if run.restored == nil {
+				run.restored = make(map[string]string)
+			}
+			run.restored[sha1Str] = targetFile
+		}
+	}
+
+	if run.manifest != nil {
+		return run.manifest.record(targetFile, sha1Str)
+	}
+
+	return nil
+}
+
+// remapTarget relocates a file restored by GetDir according to the
+// -strip-path-prefix and -add-path-prefix flags, creating the relocated
+// file's directory if necessary.
+func (b *s3Bin) remapTarget(targetFile string) (string, error) {
+	if b.stripPathPrefix == "" && b.addPathPrefix == "" {
+		return targetFile, nil
+	}
+
+	relocated := filepath.Clean(targetFile)
+	if b.stripPathPrefix != "" {
+		rel, err := filepath.Rel(filepath.Clean(b.stripPathPrefix), relocated)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return "", errors.Errorf("%q is not under %q", targetFile, b.stripPathPrefix)
+		}
+		relocated = rel
+	}
+
+	if b.addPathPrefix != "" {
+		relocated = filepath.Join(b.addPathPrefix, relocated)
+	}
+
+	err := os.MkdirAll(filepath.Dir(relocated), 0755)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to create directory for %q", relocated)
+	}
+
+	return relocated, nil
+}
+
+// recordedHash returns the hash recorded for file, which is a .sha1 file,
+// or with -lock-file, the file itself.
+func (b *s3Bin) recordedHash(file string) (string, error) {
+	if b.lockFile != "" {
+		return b.lockedHash(file)
+	}
+	return b.readSidecar(file)
+}
+
+// parseSidecarFile returns the hash in sha1File, without the
+// -check-sidecar-perms check of (*s3Bin).readSidecar.
+func parseSidecarFile(sha1File string) (string, error) {
+	sha1Bytes, err := ioutil.ReadFile(sha1File)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to read sha1 file %q", sha1File)
+	}
+
+	sha1Str := sidecarHash(string(sha1Bytes))
+	if !isValidHash(sha1Str) {
+		return "", errors.Wrapf(ErrInvalidSidecar, "sha1 file %q is invalid", sha1File)
+	}
+
+	return sha1Str, nil
+}
+
+// normalizeHash returns the hash in s, the contents of a .sha1 file or a
+// hash given by the user, in lowercase. Besides surrounding whitespace, it
+// tolerates a UTF-8 byte order mark, and trailing fields such as the file
+// name in the output of sha1sum.
+func normalizeHash(s string) string {
+	s = strings.TrimPrefix(s, "\ufeff")
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return ""
+	}
+	return strings.ToLower(fields[0])
+}
+
+func isValidHash(hash string) bool {
+	if len(hash) != 40 {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
+
+// maxIOBufferSize is the largest -io-buffer-size.
+const maxIOBufferSize = 64 << 20
+
+// copyBuffer copies src to dst through a buffer of bufSize bytes, or
+// io.Copy's default buffer if bufSize is 0. Unlike io.CopyBuffer, it uses
+// the buffer even if src or dst could copy by themselves, as files do.
+func copyBuffer(dst io.Writer, src io.Reader, bufSize int) (int64, error) {
+	if bufSize == 0 {
+		return io.Copy(dst, src)
+	}
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src},
+		make([]byte, bufSize))
+}
+
+// calcSha1 returns the hash of the file at path, read through a buffer of
+// bufSize bytes as with copyBuffer.
+func calcSha1(path string, bufSize int) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to open file")
+	}
+	defer f.Close()
+
+	hash := sha1.New()
+	_, err = copyBuffer(hash, f, bufSize)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to read file")
+	}
+
+	return strings.ToLower(hex.EncodeToString(hash.Sum(nil))), nil
+}
+
+// calcMD5 returns the base64 encoded MD5 of the contents of r, as expected
+// by Content-MD5, and rewinds r.
+func calcMD5(r io.ReadSeeker) (string, error) {
+	hash := md5.New()
+	_, err := io.Copy(hash, r)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to read file")
+	}
+
+	_, err = r.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to rewind file")
+	}
+
+	return base64.StdEncoding.EncodeToString(hash.Sum(nil)), nil
+}
+
+// parseACL validates the -acl flag against S3's canned ACLs.
+func parseACL(acl string) (*string, error) {
+	for _, valid := range s3.ObjectCannedACL_Values() {
+		if acl == valid {
+			return aws.String(acl), nil
+		}
+	}
+
+	return nil, errors.Errorf("invalid -acl %q: must be one of %s",
+		acl, strings.Join(s3.ObjectCannedACL_Values(), ", "))
+}
+
+// parseSince parses the -since flag, which is either a duration before now,
+// or an RFC 3339 timestamp.
+func parseSince(since string) (time.Time, error) {
+	d, err := time.ParseDuration(since)
+	if err == nil {
+		return time.Now().Add(-d), nil
+	}
+
+	t, err := time.Parse(time.RFC3339, since)
+	if err != nil {
+		return time.Time{}, errors.Errorf(
+			"invalid -since %q: must be a duration or RFC 3339 time", since)
+	}
+
+	return t, nil
+}
+
+// objectKey returns the key of the object stored for hash, under the
+// configured prefix.
+func (b *s3Bin) objectKey(hash string) (string, error) {
+	key, err := b.relativeKey(hash)
+	if err != nil {
+		return "", err
+	}
+	return prefixedKey(b.prefix, key), nil
+}
+
+// prefixedKey returns key, relative to prefix, as a key of the bucket.
+func prefixedKey(prefix, key string) string {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return key
+	}
+	return prefix + "/" + key
+}
+
+// storeKey returns the key of the object for hash, relative to the prefix.
+// The first keyPrefixBytes hex digits of the hash form the first segment
+// of the key, and the rest of the first 20 digits are split in segments of
+// 4. keyPrefixBytes of 0 is the default of 4.
+func storeKey(hash string, keyPrefixBytes int) string {
+	if keyPrefixBytes == 0 {
+		keyPrefixBytes = defaultKeyPrefixBytes
+	}
+
+	segments := []string{hash[:keyPrefixBytes]}
+	for i := keyPrefixBytes; i < storeKeyDigits; i += 4 {
+		end := i + 4
+		if end > storeKeyDigits {
+			end = storeKeyDigits
+		}
+		segments = append(segments, hash[i:end])
+	}
+	return strings.Join(segments, "/")
+}
+
+func main() {
+	var (
 		flagS3Bucket  = flag.String("s3-bucket", "", "`name` of S3 bucket where binaries are stored")
-		flagAWSRegion = flag.String("aws-region", "", "S3 bucket's `AWS region`")
+		flagAWSRegion = flag.String("aws-region", "", "S3 bucket's `AWS region` (default from AWS_REGION, AWS_DEFAULT_REGION or the AWS profile)")
 		flagGet       = flag.String("get", "", "download file given corresponding `sha1 file`")
 		flagGetDir    = flag.String("get-dir", "", "download all files in `directory`")
 		flagPut       = flag.String("put", "", "put `file` in S3 and create corresponding .sha1 file")
+		flagLockFile  = flag.String("lock-file", "", "record and read hashes in lock `file` instead of .sha1 files")
+		flagReqSide   = flag.Bool("require-sidecars", false, "fail -get-dir if it finds no files to download in the directory")
+		flagReqAll    = flag.Bool("require-all-sidecars", false, "fail -get-dir if any file in the directory has no .sha1 file")
+		flagCacheDir  = flag.String("cache-dir", "", "cache the hashes of local files checked by -get and -get-dir, and the key layout of the prefix, in `directory`")
+		flagResume    = flag.String("resume-manifest", "", "record files restored by -get-dir in manifest `file`, and skip them on restart")
+		flagReqPayer  = flag.Bool("request-payer", false, "accept request charges when reading from a requester-pays bucket")
+		flagVerify    = flag.Bool("verify-after-put", false, "download and verify the object after -put, before creating the .sha1 file")
+		flagVerifyDel = flag.Bool("verify-cleanup", false, "delete the object if -verify-after-put fails")
+		flagLockMode  = flag.String("object-lock-mode", "", "object lock retention `mode` (GOVERNANCE or COMPLIANCE) for -put")
+		flagLockUntil = flag.String("object-lock-until", "", "retain objects put with -object-lock-mode until `date` (RFC 3339 or YYYY-MM-DD)")
+		flagHook      = flag.String("on-download", "", "run `command` with the path of every downloaded file as its last argument")
+		flagRetryHash = flag.Int("retry-on-mismatch", 0, "download content again up to `n` times if it does not match its hash, which implies checking it")
+		flagSidePerms = flag.Bool("check-sidecar-perms", false, "refuse to use .sha1 files and lock files that are writable by their group or others")
+		flagUnchanged = flag.Bool("skip-unchanged", false, "skip -put if the file's .sha1 file is current and its object is stored")
+		flagHardlink  = flag.Bool("hardlink-dedup", false, "restore -get-dir files with the same content as hard links to one another, or copies where links are not supported")
+		flagSummary   = flag.String("summary-out", "", "write the results of the run, and of each file, to the JSON `file`")
+		flagHeal      = flag.Bool("heal", false, "with -get and -get-dir, upload local files that match their .sha1 file if their object is missing")
+		flagMissing   = flag.Bool("missing-only", false, "with -get and -get-dir, only download files that do not exist locally, without checking the hashes of those that do")
+		flagNewer     = flag.Bool("prefer-newer", false, "with -get and -get-dir, only replace local files that do not match their .sha1 file with objects newer than them")
+		flagStrictKey = flag.Bool("strict-key", false, "fail if downloaded content does not match the hash it is stored under")
+		flagCreate    = flag.Bool("create-bucket", false, "create the S3 bucket on -put if it does not exist")
+		flagRaw       = flag.Bool("raw", false, "store the file as-is on -put, without compression or header")
+		flagCompress  = flag.String("compress", "", "with `auto-best`, store each file on -put in whichever format and compression level is smallest")
+		flagIOBuffer  = flag.String("io-buffer-size", "", "`size` of the buffer files are read and written through when hashed, packed and downloaded (default 32K)")
+		flagTarFmt    = flag.String("tar-format", "pax", "`format` of the tar headers of objects stored by -put: pax, gnu or ustar")
+		flagBestMax   = flag.String("compress-max-size", "64M", "`size` of the largest file -compress auto-best tries formats for")
+		flagGzip      = flag.Bool("gzip", false, "store the file gzip-compressed on -put, without tar wrapper, and its header in object metadata")
+		flagXattr     = flag.Bool("preserve-xattr", false, "store extended attributes on -put, and restore them on -get")
+		flagCaps      = flag.Bool("preserve-caps", false, "store Linux file capabilities on -put, and restore them on -get, which requires CAP_SETFCAP")
+		flagSince     = flag.String("since", "", "skip .sha1 files in -get-dir modified before `time` (a duration ago, or RFC 3339)")
+		flagKeyPrefix = flag.Int("key-prefix-bytes", 0, "use the first `n` hex digits of the hash as the first segment of object keys (default 4)")
+		flagKeyTmpl   = flag.String("key-template", "", "derive object keys from the hash with Go `template`, using {{.Hash}}, {{.Hash4}}, slice and printf; recorded for the prefix like -key-prefix-bytes")
+		flagSources   = flag.String("sources", "", "read from whichever of the replicated buckets in `region=bucket,...` answers fastest, instead of -s3-bucket")
+		flagS3URI     = flag.String("s3-uri", "", "`s3://bucket/prefix` URI of where binaries are stored, instead of -s3-bucket and -s3-prefix")
+		flagPrefix    = flag.String("s3-prefix", "", "`prefix` of the keys of stored objects")
+		flagPromote   = flag.String("promote", "", "copy the object for `sha1 file` to the -to-prefix prefix")
+		flagOrphans   = flag.String("list-orphans", "", "list the .sha1 files under `directory` whose objects are missing")
+		flagMirror    = flag.String("mirror", "", "copy the objects of the .sha1 files under `directory` into the -to directory, in the layout of the prefix")
+		flagConc      = flag.Int("concurrency", 8, "`number` of objects checked at once by -list-orphans, -mirror and -check-space")
+		flagMaxConns  = flag.Int("max-conns-per-host", 0, "open at most `number` connections to S3 at once, or any number if 0")
+		flagIdleConns = flag.Int("max-idle-conns-per-host", 0, "keep up to `number` connections to S3 open for reuse (default -concurrency)")
+		flagHashWork  = flag.Int("hash-workers", runtime.NumCPU(), "`number` of local files -get-dir checks for being up-to-date at once")
+		flagSpace     = flag.Bool("check-space", false, "fail -get-dir before downloading anything if there is not enough free space for the files")
+		flagPresign   = flag.String("presign", "", "print a URL anyone can download the object for `sha1 file` from, until -expires")
+		flagExpires   = flag.Duration("expires", time.Hour, "`duration` -presign URLs are valid for, at most 168h")
+		flagPresRaw   = flag.Bool("presign-raw", false, "presign objects that are not stored as the file itself, e.g. as tar.gz, as they are stored")
+		flagCompare   = flag.String("compare", "", "check that the object for the hash of `file` has the same content, byte for byte, without a .sha1 file")
+		flagRepack    = flag.String("repack", "", "store the object for `sha1 file` again in the format selected by -raw, -gzip or -compress, without the original file")
+		flagTouch     = flag.String("touch", "", "reset the last-modified time of the object for `sha1 file`, without uploading it again")
+		flagToPrefix  = flag.String("to-prefix", "", "destination `prefix` for -promote")
+		flagStripPath = flag.String("strip-path-prefix", "", "remove `directory` from the paths of files restored by -get-dir")
+		flagAddPath   = flag.String("add-path-prefix", "", "restore -get-dir files under `directory`")
+		flagRelRoot   = flag.String("relative-root", "", "record in JSON .sha1 files written by -put the paths of their files relative to `directory`, and restore those files there with -get-dir")
+		flagACL       = flag.String("acl", "", "canned `ACL` for objects put in S3, e.g. bucket-owner-full-control")
+		flagChecksum  = flag.String("s3-checksum", "", "S3 checksum `algorithm` (CRC32, CRC32C, SHA1 or SHA256) to validate transfers with")
+		flagSelfTest  = flag.Bool("selftest", false, "put, get, verify and delete a random file to test the S3 bucket and s3bin")
+		flagDedup     = flag.String("dedup-report", "", "report how much space deduplication would save in `directory`, without using S3")
+		flagJSON      = flag.Bool("json", false, "print reports as JSON")
+		flagPutKey    = flag.String("put-key", "", "store the file of -put under `key` instead of under its hash")
+		flagGetStdout = flag.String("get-stdout", "", "write the content of the file for `sha1 file` to stdout, checking it against its hash")
+		flagGetStdin  = flag.Bool("get-sidecar-stdin", false, "download the file whose hash is read from stdin to the -o file")
+		flagImport    = flag.String("import", "", "adopt the object at `key`, uploaded by other means, by downloading it to the -o file, storing it by its hash and recording the hash")
+		flagGetKey    = flag.String("get-key", "", "download the object stored with -put-key under `key` to the -o file")
+		flagDumpHdr   = flag.String("dump-header", "", "print the JSON header of the object for `sha1 file`, downloading only its beginning")
+		flagDump      = flag.String("dump-object", "", "save the stored object for `sha1 file` to the -o file as-is, without unpacking it")
+		flagOutput    = flag.String("o", "", "output `file`")
+		flagRepair    = flag.String("repair", "", "re-upload files in `directory` whose objects are missing or fail verification")
+		flagVersionID = flag.String("version-id", "", "read `version` of the object with -get, -get-stdout, -stat, -dump-object, -dump-header or -presign, in versioned buckets")
+		flagStat      = flag.String("stat", "", "print information about the object for `sha1 file` without downloading it")
+		flagStrictFmt = flag.Bool("strict-format", false, "reject objects that do not match their format exactly, e.g. with extra tar members")
+		flagChunked   = flag.Bool("chunked", false, "split files into content-defined chunks on -put, and store each chunk once")
+		flagParanoid  = flag.Bool("paranoid", false, "with -chunked, download chunks that are already stored and fail if their content differs")
+		flagDelSource = flag.Bool("delete-source", false, "delete the file after -put stores, verifies and records it; requires -verify-after-put")
+		flagNoSidecar = flag.Bool("no-sidecar", false, "print the hash to stdout on -put instead of creating the .sha1 file")
+		flagSideFmt   = flag.String("sidecar-format", sidecarPlain, "`format` of the .sha1 files written by -put: plain, or json to record the size as well")
+		flagGitignore = flag.Bool("gitignore", false, "add the file to the nearest .gitignore on -put, so that only its .sha1 file is committed")
+		flagNormMode  = flag.String("normalize-mode", "", "store `mode` (octal) with every file on -put instead of its own, or with \"exec\", 0755 for executables and 0644 otherwise")
+		flagRecName   = flag.Bool("record-name", false, "record the name of the file in the object's header on -put")
+		flagResumable = flag.Bool("resumable-uploads", false, "upload large objects in parts, and resume uploads that failed when putting the file again (requires -cache-dir)")
+		flagInflight  = flag.String("max-inflight-bytes", "", "cap the combined `size` of the objects -mirror copies at once (e.g. 256M); copies wait for room. Other modes transfer one object at a time")
+		flagMaxBytes  = flag.String("max-prefix-bytes", "", "refuse to store objects that would take the prefix over `size` bytes (e.g. 500M, 2G)")
+		flagMaxObjs   = flag.Int64("max-prefix-objects", 0, "refuse to store objects that would take the prefix over `number` objects")
+		flagAutoTier  = flag.Bool("auto-tier", false, "store objects for files of at least -auto-tier-threshold bytes in the INTELLIGENT_TIERING storage class, and others in STANDARD")
+		flagTierSize  = flag.String("auto-tier-threshold", "128K", "`size` from which -auto-tier stores objects in INTELLIGENT_TIERING (e.g. 128K, 1M)")
+		flagBandwidth = flag.String("max-bandwidth-total", "", "cap the combined bandwidth of all transfers at `rate` bytes per second (e.g. 512K, 10M)")
+		flagHeartbeat = flag.Duration("heartbeat", 0, "log that a transfer is still going every `interval`")
+		flagProgress  = flag.Bool("progress-json", false, "report the progress of transfers to stderr as lines of JSON with the bytes transferred and total")
+		flagTimeout   = flag.Duration("per-object-timeout", 0, "cancel the transfer of an object if it takes longer than `duration`")
+		flagExplain   = flag.Bool("explain", false, "log the S3 requests -put, -promote, -touch or -repair make, without sending those that write")
+		flagAttempt   = flag.Duration("attempt-timeout", 0, "retry an S3 request if an attempt gets no response within `duration`")
+		flagFindRefs  = flag.String("find-refs", "", "print the .sha1 files in a directory that refer to `hash`, without using S3")
+		flagMerge     = flag.String("merge", "", "merge the .sha1 files of comma-separated `directories` into the -to directory, without using S3")
+		flagTo        = flag.String("to", "", "destination `directory`")
+		flagConflict  = flag.String("on-conflict", onConflictFail, "whether -merge conflicts `fail`, or the first or last .sha1 file wins")
 	)
 
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "s3bin [options] -get <file.sha1>\n")
+		fmt.Fprintf(os.Stderr, "s3bin [options] -get-stdout <file.sha1>\n")
 		fmt.Fprintf(os.Stderr, "s3bin [options] -get-dir <directory>\n")
+		fmt.Fprintf(os.Stderr, "s3bin [options] -get-sidecar-stdin -o <file>\n")
 		fmt.Fprintf(os.Stderr, "s3bin [options] -put <file>\n")
+		fmt.Fprintf(os.Stderr, "s3bin [options] -put <file> -put-key <key>\n")
+		fmt.Fprintf(os.Stderr, "s3bin [options] -get-key <key> -o <file>\n")
+		fmt.Fprintf(os.Stderr, "s3bin [options] -import <key> -o <file>\n")
+		fmt.Fprintf(os.Stderr, "s3bin [options] -promote <file.sha1> -to-prefix <prefix>\n")
+		fmt.Fprintf(os.Stderr, "s3bin [options] -touch <file.sha1>\n")
+		fmt.Fprintf(os.Stderr, "s3bin [options] [-raw|-gzip|-compress auto-best] -repack <file.sha1>\n")
+		fmt.Fprintf(os.Stderr, "s3bin [options] [-expires <duration>] [-presign-raw] -presign <file.sha1>\n")
+		fmt.Fprintf(os.Stderr, "s3bin [options] [-concurrency <n>] -list-orphans <directory>\n")
+		fmt.Fprintf(os.Stderr, "s3bin [options] [-concurrency <n>] -mirror <directory> -to <directory>\n")
+		fmt.Fprintf(os.Stderr, "s3bin [options] [-json] -stat <file.sha1>\n")
+		fmt.Fprintf(os.Stderr, "s3bin [options] -compare <file>\n")
+		fmt.Fprintf(os.Stderr, "s3bin [options] -repair <directory>\n")
+		fmt.Fprintf(os.Stderr, "s3bin [options] -dump-object <file.sha1> -o <file>\n")
+		fmt.Fprintf(os.Stderr, "s3bin [options] -dump-header <file.sha1>\n")
+		fmt.Fprintf(os.Stderr, "s3bin [options] -selftest\n")
+		fmt.Fprintf(os.Stderr, "s3bin [-json] -dedup-report <directory>\n")
+		fmt.Fprintf(os.Stderr, "s3bin -find-refs <hash> <directory>\n")
+		fmt.Fprintf(os.Stderr, "s3bin [-on-conflict fail|first|last] -merge <dir1,dir2,...> -to <directory>\n")
 		fmt.Fprintf(os.Stderr, "\n")
 		fmt.Fprintf(os.Stderr, "s3bin downloads or uploads binary files from/to a AWS S3 bucket. \n")
 		fmt.Fprintf(os.Stderr, "\n")
@@ -305,6 +1742,16 @@ func main() {
 		fmt.Fprintf(os.Stderr, "the corresponding file from S3 iff the corresponding local file dos not exist \n")
 		fmt.Fprintf(os.Stderr, "or its contents do not match the provided hash.\n")
 		fmt.Fprintf(os.Stderr, "\n")
+		fmt.Fprintf(os.Stderr, "With the -lock-file flag, hashes are recorded in and read from a single JSON \n")
+		fmt.Fprintf(os.Stderr, "lock file instead of .sha1 files. -get then takes the file itself, and \n")
+		fmt.Fprintf(os.Stderr, "-get-dir downloads every file in the lock file under the directory.\n")
+		fmt.Fprintf(os.Stderr, "\n")
+		fmt.Fprintf(os.Stderr, "The bucket and prefix can be given as a single s3://bucket/prefix URI with \n")
+		fmt.Fprintf(os.Stderr, "-s3-uri. The bucket's region is then looked up unless -aws-region is given.\n")
+		fmt.Fprintf(os.Stderr, "Otherwise, without -aws-region, the region is taken from AWS_REGION, \n")
+		fmt.Fprintf(os.Stderr, "AWS_DEFAULT_REGION, or the region of the AWS profile in ~/.aws/config, in \n")
+		fmt.Fprintf(os.Stderr, "that order.\n")
+		fmt.Fprintf(os.Stderr, "\n")
 		os.Exit(1)
 	}
 
@@ -312,39 +1759,467 @@ func main() {
 
 	log.SetFlags(0)
 
+	ioBufferSize := 0
+	if *flagIOBuffer != "" {
+		size, ok := parseSize(*flagIOBuffer)
+		if !ok || size <= 0 || size > maxIOBufferSize {
+			log.Fatalf("invalid -io-buffer-size %q", *flagIOBuffer)
+		}
+		ioBufferSize = int(size)
+	}
+
+	// Local modes don't need a bucket.
+	if *flagDedup != "" {
+		err := dedupReport(os.Stdout, *flagDedup, *flagJSON, ioBufferSize)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	} else if *flagFindRefs != "" {
+		if flag.NArg() != 1 {
+			log.Println("-find-refs requires a directory")
+			flag.Usage()
+		}
+
+		err := findRefs(os.Stdout, *flagFindRefs, flag.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	} else if *flagMerge != "" {
+		if *flagTo == "" {
+			log.Println("-to is required")
+			flag.Usage()
+		}
+
+		err := mergeSidecars(strings.Split(*flagMerge, ","), *flagTo, *flagConflict)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *flagS3URI != "" {
+		bucket, prefix, err := parseS3URI(*flagS3URI)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *flagS3Bucket != "" && *flagS3Bucket != bucket {
+			log.Fatalf("-s3-bucket %q does not match -s3-uri", *flagS3Bucket)
+		}
+		if *flagPrefix != "" && strings.Trim(*flagPrefix, "/") != prefix {
+			log.Fatalf("-s3-prefix %q does not match -s3-uri", *flagPrefix)
+		}
+		*flagS3Bucket = bucket
+		*flagPrefix = prefix
+	}
+
+	var sources []*source
+	if *flagSources != "" {
+		if *flagS3Bucket != "" || *flagAWSRegion != "" {
+			log.Fatal("-sources is not supported with -s3-bucket, -aws-region or -s3-uri")
+		}
+		if *flagPut != "" || *flagPromote != "" || *flagRepair != "" || *flagTouch != "" ||
+			*flagImport != "" || *flagRepack != "" || *flagHeal || *flagSelfTest {
+			log.Fatal("-sources is only supported by modes that read objects")
+		}
+
+		var err error
+		sources, err = parseSources(*flagSources)
+		if err != nil {
+			log.Fatal(err)
+		}
+		*flagS3Bucket = sources[0].bucket
+		*flagAWSRegion = sources[0].region
+	}
+
 	if *flagS3Bucket == "" {
 		log.Println("-s3-bucket is required")
 		flag.Usage()
 	}
 
-	if *flagAWSRegion == "" {
-		log.Println("-aws-region is required")
+	if *flagGet == "" && *flagGetStdout == "" && *flagGetDir == "" && *flagPut == "" &&
+		*flagPromote == "" && *flagStat == "" && *flagRepair == "" && *flagDump == "" &&
+		*flagDumpHdr == "" && *flagGetKey == "" && *flagTouch == "" && *flagOrphans == "" &&
+		*flagMirror == "" && *flagPresign == "" && *flagImport == "" && *flagRepack == "" &&
+		*flagCompare == "" && !*flagGetStdin && !*flagSelfTest {
 		flag.Usage()
 	}
 
-	if *flagGet == "" && *flagGetDir == "" && *flagPut == "" {
+	s3Bin, err := newS3Bin(*flagAWSRegion, *flagS3Bucket)
+	if err != nil {
+		log.Fatal(err)
+	}
+	s3Bin.ioBufferSize = ioBufferSize
+
+	if *flagMaxConns < 0 {
+		log.Fatal("-max-conns-per-host must not be negative")
+	}
+	if *flagIdleConns < 0 {
+		log.Fatal("-max-idle-conns-per-host must not be negative")
+	}
+	idleConns := *flagIdleConns
+	if idleConns == 0 {
+		idleConns = *flagConc
+	}
+	if *flagMaxConns > 0 && idleConns > *flagMaxConns {
+		idleConns = *flagMaxConns
+	}
+	s3Bin.setHTTPClient(newHTTPClient(*flagMaxConns, idleConns))
+
+	if sources != nil {
+		err = s3Bin.selectSource(sources)
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else if *flagAWSRegion == "" && *flagS3URI != "" {
+		// With -s3-uri, the bucket's region is looked up if it is not
+		// given, rather than taken from the environment.
+		err = s3Bin.resolveRegion()
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else if aws.StringValue(s3Bin.s3Cli.Config.Region) == "" {
+		log.Println("-aws-region is required unless AWS_REGION, AWS_DEFAULT_REGION or the AWS profile sets a region")
 		flag.Usage()
 	}
 
-	s3Bin, err := newS3Bin(*flagAWSRegion, *flagS3Bucket)
+	s3Bin.prefix = *flagPrefix
+	s3Bin.lockFile = *flagLockFile
+	s3Bin.noSidecar = *flagNoSidecar
+	if s3Bin.noSidecar && s3Bin.lockFile != "" {
+		log.Fatal("-no-sidecar is not supported with -lock-file")
+	}
+	s3Bin.resumeManifest = *flagResume
+	s3Bin.cacheDir = *flagCacheDir
+	s3Bin.resumableUploads = *flagResumable
+	if s3Bin.resumableUploads && s3Bin.cacheDir == "" {
+		log.Fatal("-resumable-uploads requires -cache-dir")
+	}
+	if *flagCacheDir != "" {
+		s3Bin.statCache, err = openStatCache(*flagCacheDir, s3Bin.ioBufferSize)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer s3Bin.statCache.Close()
+	}
+	s3Bin.requireSidecars = *flagReqSide
+	s3Bin.requireAllSidecars = *flagReqAll
+	if s3Bin.requireAllSidecars && s3Bin.lockFile != "" {
+		log.Fatal("-require-all-sidecars is not supported with -lock-file")
+	}
+	if *flagConc < 1 {
+		log.Fatal("-concurrency must be at least 1")
+	}
+	s3Bin.concurrency = *flagConc
+	if *flagHashWork < 1 {
+		log.Fatal("-hash-workers must be at least 1")
+	}
+	s3Bin.hashWorkers = *flagHashWork
+	s3Bin.checkFreeSpace = *flagSpace
+	s3Bin.perObjectTimeout = *flagTimeout
+	if *flagAttempt < 0 {
+		log.Fatal("-attempt-timeout must not be negative")
+	}
+	if *flagAttempt > 0 {
+		s3Bin.setAttemptTimeout(*flagAttempt)
+	}
+	if *flagExplain {
+		if *flagPut == "" && *flagPromote == "" && *flagTouch == "" && *flagRepair == "" {
+			log.Fatal("-explain requires -put, -promote, -touch or -repair")
+		}
+		if *flagVerify || *flagResumable {
+			log.Fatal("-explain is not supported with -verify-after-put or -resumable-uploads")
+		}
+		s3Bin.setExplain()
+	}
+	s3Bin.heartbeatInterval = *flagHeartbeat
+	if *flagProgress {
+		s3Bin.setProgressJSON()
+	}
+	if *flagBandwidth != "" {
+		bandwidth, err := parseBandwidth(*flagBandwidth)
+		if err != nil {
+			log.Fatal(err)
+		}
+		s3Bin.setMaxBandwidth(bandwidth)
+	}
+	if *flagInflight != "" {
+		capacity, ok := parseSize(*flagInflight)
+		if !ok || capacity <= 0 {
+			log.Fatalf("invalid -max-inflight-bytes %q", *flagInflight)
+		}
+		s3Bin.inflight = newInflightLimit(capacity)
+	}
+	if *flagMaxBytes != "" || *flagMaxObjs != 0 {
+		s3Bin.quota = &prefixQuota{
+			prefix:     s3Bin.prefix,
+			maxObjects: *flagMaxObjs,
+		}
+		if *flagMaxBytes != "" {
+			var ok bool
+			s3Bin.quota.maxBytes, ok = parseSize(*flagMaxBytes)
+			if !ok {
+				log.Fatalf("invalid -max-prefix-bytes %q", *flagMaxBytes)
+			}
+		}
+		if *flagMaxObjs < 0 {
+			log.Fatal("-max-prefix-objects must not be negative")
+		}
+	}
+	if *flagAutoTier {
+		threshold, ok := parseSize(*flagTierSize)
+		if !ok {
+			log.Fatalf("invalid -auto-tier-threshold %q", *flagTierSize)
+		}
+		s3Bin.autoTierThreshold = threshold
+	}
+	s3Bin.stripPathPrefix = *flagStripPath
+	s3Bin.addPathPrefix = *flagAddPath
+	s3Bin.objectLockMode, s3Bin.objectLockUntil, err = parseObjectLock(
+		*flagLockMode, *flagLockUntil)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	if *flagGet != "" {
-		err = s3Bin.Get(*flagGet)
+	s3Bin.strictKey = *flagStrictKey
+	s3Bin.preferNewer = *flagNewer
+	s3Bin.missingOnly = *flagMissing
+	s3Bin.heal = *flagHeal
+	if s3Bin.heal && s3Bin.missingOnly {
+		log.Fatal("-heal is not supported with -missing-only, which does not check local files")
+	}
+	s3Bin.hardlinkDedup = *flagHardlink
+	s3Bin.skipUnchanged = *flagUnchanged
+	if s3Bin.hardlinkDedup && s3Bin.preferNewer {
+		log.Fatal("-hardlink-dedup is not supported with -prefer-newer")
+	}
+	if *flagSummary != "" {
+		s3Bin.summary = &summary{}
+	}
+	s3Bin.checkSidecarPerms = *flagSidePerms
+	if *flagRetryHash < 0 {
+		log.Fatal("-retry-on-mismatch must not be negative")
+	}
+	s3Bin.mismatchRetries = *flagRetryHash
+	if strings.TrimSpace(*flagHook) != "" {
+		s3Bin.onDownload = *flagHook
+	}
+	s3Bin.strictFormat = *flagStrictFmt
+	s3Bin.raw = *flagRaw
+	s3Bin.preserveXattr = *flagXattr
+	s3Bin.preserveCaps = *flagCaps
+	s3Bin.gzipOnly = *flagGzip
+	tarFormat, ok := parseTarFormat(*flagTarFmt)
+	if !ok {
+		log.Fatalf("invalid -tar-format %q: must be pax, gnu or ustar", *flagTarFmt)
+	}
+	s3Bin.tarFormat = tarFormat
+	if s3Bin.raw && s3Bin.gzipOnly {
+		log.Fatal("-gzip is not supported with -raw")
+	}
+	switch *flagCompress {
+	case "":
+	case "auto-best":
+		if s3Bin.raw || s3Bin.gzipOnly {
+			log.Fatal("-compress is not supported with -raw or -gzip")
+		}
+		s3Bin.autoBest = true
+		var ok bool
+		s3Bin.autoBestMaxSize, ok = parseSize(*flagBestMax)
+		if !ok {
+			log.Fatalf("invalid -compress-max-size %q", *flagBestMax)
+		}
+	default:
+		log.Fatalf("invalid -compress %q", *flagCompress)
+	}
+	s3Bin.recordName = *flagRecName
+	if *flagNormMode == "exec" {
+		s3Bin.normalizeExec = true
+	} else if *flagNormMode != "" {
+		mode, err := strconv.ParseUint(*flagNormMode, 8, 32)
+		if err != nil || mode&^0777 != 0 {
+			log.Fatalf("invalid -normalize-mode %q", *flagNormMode)
+		}
+		normalized := os.FileMode(mode)
+		s3Bin.normalizeMode = &normalized
+	}
+	s3Bin.gitignore = *flagGitignore
+	if *flagSideFmt != sidecarPlain && *flagSideFmt != sidecarJSON {
+		log.Fatalf("invalid -sidecar-format %q: must be %s or %s",
+			*flagSideFmt, sidecarPlain, sidecarJSON)
+	}
+	s3Bin.sidecarFormat = *flagSideFmt
+	s3Bin.relativeRoot = *flagRelRoot
+	if s3Bin.relativeRoot != "" {
+		if *flagPut != "" && s3Bin.sidecarFormat != sidecarJSON {
+			log.Fatal("-relative-root with -put requires -sidecar-format json")
+		}
+		if s3Bin.stripPathPrefix != "" || s3Bin.addPathPrefix != "" {
+			log.Fatal("-relative-root is not supported with -strip-path-prefix or -add-path-prefix")
+		}
+		if s3Bin.lockFile != "" {
+			log.Fatal("-relative-root is not supported with -lock-file")
+		}
+	}
+	s3Bin.chunked = *flagChunked
+	if s3Bin.chunked && *flagPutKey != "" {
+		log.Fatal("-chunked is not supported with -put-key")
+	}
+	s3Bin.paranoid = *flagParanoid
+	if s3Bin.paranoid && !s3Bin.chunked {
+		log.Fatal("-paranoid requires -chunked")
+	}
+	if *flagRepack != "" && s3Bin.chunked {
+		log.Fatal("-repack is not supported with -chunked")
+	}
+	if s3Bin.raw && s3Bin.preserveXattr {
+		log.Fatal("-preserve-xattr is not supported with -raw")
+	}
+	if s3Bin.raw && s3Bin.preserveCaps {
+		log.Fatal("-preserve-caps is not supported with -raw")
+	}
+	if s3Bin.raw && s3Bin.recordName {
+		log.Fatal("-record-name is not supported with -raw")
+	}
+
+	if *flagSince != "" {
+		s3Bin.since, err = parseSince(*flagSince)
 		if err != nil {
 			log.Fatal(err)
 		}
-	} else if *flagGetDir != "" {
-		err = s3Bin.GetDir(*flagGetDir)
+	}
+	if *flagACL != "" {
+		s3Bin.acl, err = parseACL(*flagACL)
 		if err != nil {
 			log.Fatal(err)
 		}
-	} else if *flagPut != "" {
-		err = s3Bin.Put(*flagPut)
+	}
+
+	if *flagChecksum != "" {
+		s3Bin.s3Checksum, err = parseS3Checksum(*flagChecksum)
 		if err != nil {
 			log.Fatal(err)
 		}
 	}
+
+	if *flagVersionID != "" {
+		if *flagGet == "" && *flagGetStdout == "" && *flagStat == "" && *flagDump == "" &&
+			*flagDumpHdr == "" && *flagPresign == "" && !*flagGetStdin {
+			log.Fatal("-version-id requires -get, -get-stdout, -stat, -dump-object, -dump-header or -presign")
+		}
+		s3Bin.versionID = flagVersionID
+	}
+
+	s3Bin.verifyAfterPut = *flagVerify
+	s3Bin.verifyCleanup = *flagVerifyDel
+	s3Bin.deleteSourceFile = *flagDelSource
+	if s3Bin.deleteSourceFile && !s3Bin.verifyAfterPut {
+		log.Fatal("-delete-source requires -verify-after-put")
+	}
+	if *flagReqPayer {
+		s3Bin.requestPayer = aws.String(s3.RequestPayerRequester)
+	}
+
+	run := func() error {
+		if *flagPut != "" && *flagCreate {
+			err := s3Bin.createBucket()
+			if err != nil {
+				return err
+			}
+		}
+
+		err := s3Bin.setupKeyLayout(*flagKeyPrefix, *flagKeyTmpl, *flagPut != "" && *flagPutKey == "")
+		if err != nil {
+			return err
+		}
+
+		if *flagGet != "" {
+			return s3Bin.Get(*flagGet)
+		} else if *flagGetStdout != "" {
+			return s3Bin.GetStdout(*flagGetStdout)
+		} else if *flagGetDir != "" {
+			return s3Bin.GetDir(*flagGetDir)
+		} else if *flagGetStdin {
+			if *flagOutput == "" {
+				log.Println("-o is required")
+				flag.Usage()
+			}
+
+			return s3Bin.GetHash(os.Stdin, *flagOutput)
+		} else if *flagPut != "" {
+			if *flagPutKey != "" {
+				return s3Bin.PutKey(*flagPut, *flagPutKey)
+			}
+			return s3Bin.Put(*flagPut)
+		} else if *flagPromote != "" {
+			if *flagToPrefix == "" {
+				log.Println("-to-prefix is required")
+				flag.Usage()
+			}
+
+			return s3Bin.Promote(*flagPromote, *flagToPrefix)
+		} else if *flagOrphans != "" {
+			return s3Bin.ListOrphans(os.Stdout, *flagOrphans)
+		} else if *flagMirror != "" {
+			if *flagTo == "" {
+				log.Println("-to is required")
+				flag.Usage()
+			}
+
+			return s3Bin.Mirror(*flagMirror, *flagTo)
+		} else if *flagTouch != "" {
+			return s3Bin.Touch(*flagTouch)
+		} else if *flagRepack != "" {
+			return s3Bin.Repack(*flagRepack)
+		} else if *flagPresign != "" {
+			return s3Bin.Presign(os.Stdout, *flagPresign, *flagExpires, *flagPresRaw)
+		} else if *flagStat != "" {
+			return s3Bin.Stat(os.Stdout, *flagStat, *flagJSON)
+		} else if *flagCompare != "" {
+			return s3Bin.Compare(*flagCompare)
+		} else if *flagRepair != "" {
+			return s3Bin.Repair(*flagRepair)
+		} else if *flagGetKey != "" {
+			if *flagOutput == "" {
+				log.Println("-o is required")
+				flag.Usage()
+			}
+
+			return s3Bin.GetKey(*flagGetKey, *flagOutput)
+		} else if *flagImport != "" {
+			if *flagOutput == "" {
+				log.Println("-o is required")
+				flag.Usage()
+			}
+
+			return s3Bin.Import(*flagImport, *flagOutput)
+		} else if *flagDumpHdr != "" {
+			return s3Bin.DumpHeader(os.Stdout, *flagDumpHdr)
+		} else if *flagDump != "" {
+			if *flagOutput == "" {
+				log.Println("-o is required")
+				flag.Usage()
+			}
+
+			return s3Bin.DumpObject(*flagDump, *flagOutput)
+		} else if *flagSelfTest {
+			return s3Bin.SelfTest()
+		}
+		return nil
+	}
+
+	err = run()
+	if s3Bin.redirectRegion(err) {
+		err = run()
+	}
+	if s3Bin.summary != nil {
+		summaryErr := s3Bin.writeSummary(*flagSummary, err)
+		if summaryErr != nil {
+			log.Print(summaryErr)
+		}
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
 }
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	selfTestSize = 1 << 20
+	selfTestMode = 0750
+)
+
+// SelfTest round-trips a file of random bytes through the bucket: it is
+// uploaded, downloaded to a different directory, checked against the
+// original's hash and mode, and its object deleted.
+func (b *s3Bin) SelfTest() error {
+	dir, err := ioutil.TempDir("", "s3bin-selftest-")
+	if err != nil {
+		return errors.Wrap(err, "failed to create temporary directory")
+	}
+	defer os.RemoveAll(dir)
+
+	srcFile := filepath.Join(dir, "src")
+	err = writeRandomFile(srcFile, selfTestSize, selfTestMode)
+	if err != nil {
+		return err
+	}
+
+	hash, err := calcSha1(srcFile, b.ioBufferSize)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(srcFile)
+	if err != nil {
+		return errors.Wrap(err, "failed to open file")
+	}
+	defer f.Close()
+
+	err = b.putObject(hash, &Header{Version: version}, f, selfTestSize, selfTestMode, srcFile)
+	if err != nil {
+		return errors.Wrap(err, "self-test put failed")
+	}
+
+	testErr := b.selfTestGet(filepath.Join(dir, "dst"), hash)
+
+	err = b.deleteObject(hash)
+	if testErr != nil {
+		return testErr
+	} else if err != nil {
+		return errors.Wrap(err, "self-test cleanup failed")
+	}
+
+	log.Printf("Self-test passed")
+	return nil
+}
+
+func (b *s3Bin) selfTestGet(dstFile, hash string) error {
+	err := b.getFile(dstFile, hash)
+	if err != nil {
+		return errors.Wrap(err, "self-test get failed")
+	}
+
+	dstHash, err := calcSha1(dstFile, b.ioBufferSize)
+	if err != nil {
+		return err
+	}
+	if dstHash != hash {
+		return errors.Errorf(
+			"self-test failed: downloaded file has hash %s, expected %s",
+			dstHash, hash)
+	}
+
+	// Raw objects do not store the file mode.
+	if b.raw {
+		return nil
+	}
+
+	fstat, err := os.Stat(dstFile)
+	if err != nil {
+		return errors.Wrap(err, "failed to read file attributes")
+	}
+	if fstat.Mode().Perm() != selfTestMode {
+		return errors.Errorf(
+			"self-test failed: downloaded file has mode %v, expected %v",
+			fstat.Mode().Perm(), os.FileMode(selfTestMode))
+	}
+
+	return nil
+}
+
+func writeRandomFile(path string, size int64, mode os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create %q", path)
+	}
+	defer f.Close()
+
+	_, err = io.CopyN(f, rand.Reader, size)
+	if err != nil {
+		return errors.Wrapf(err, "failed to write %q", path)
+	}
+
+	// Apply the mode regardless of the umask.
+	err = f.Chmod(mode)
+	if err != nil {
+		return errors.Wrap(err, "failed to set file mode")
+	}
+
+	return nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// sidecarPlain .sha1 files hold just the hash. This is the default.
+	sidecarPlain = "plain"
+
+	// sidecarJSON .sha1 files hold a jsonSidecar, which has room for more
+	// than the hash.
+	sidecarJSON = "json"
+)
+
+// jsonSidecar is the content of a .sha1 file in the JSON format.
+type jsonSidecar struct {
+	Hash string `json:"hash"`
+	Algo string `json:"algo"`
+	Size int64  `json:"size"`
+
+	// Path, if set, is the path of the file relative to -relative-root,
+	// with forward slashes.
+	Path string `json:"path,omitempty"`
+}
+
+// sidecarHash returns the hash in data, the contents of a .sha1 file in
+// either format, or "" if there is none. JSON .sha1 files are told apart by
+// their leading brace.
+func sidecarHash(data string) string {
+	trimmed := strings.TrimSpace(strings.TrimPrefix(data, "\ufeff"))
+	if !strings.HasPrefix(trimmed, "{") {
+		return normalizeHash(data)
+	}
+
+	var sidecar jsonSidecar
+	err := json.Unmarshal([]byte(trimmed), &sidecar)
+	if err != nil || (sidecar.Algo != "" && !strings.EqualFold(sidecar.Algo, "sha1")) {
+		return ""
+	}
+	return normalizeHash(sidecar.Hash)
+}
+
+// formatSidecar returns the contents of the .sha1 file of file, which has
+// the given hash and size, in the -sidecar-format format.
+func (b *s3Bin) formatSidecar(file, hash string, size int64) ([]byte, error) {
+	if b.sidecarFormat != sidecarJSON {
+		return []byte(hash), nil
+	}
+
+	sidecar := &jsonSidecar{
+		Hash: hash,
+		Algo: "sha1",
+		Size: size,
+	}
+	if b.relativeRoot != "" {
+		var err error
+		sidecar.Path, err = b.rootRelativePath(file)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	data, err := json.Marshal(sidecar)
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// readSidecar returns the hash in sha1File once -check-sidecar-perms has
+// found the file's permissions safe.
+func (b *s3Bin) readSidecar(sha1File string) (string, error) {
+	err := b.checkHashFilePerms(sha1File)
+	if err != nil {
+		return "", err
+	}
+	return parseSidecarFile(sha1File)
+}
+
+// checkHashFilePerms checks, with -check-sidecar-perms, that path, a .sha1
+// file or lock file, is not writable by its group or others. Whoever can
+// write such a file controls what Get downloads in its place.
+func (b *s3Bin) checkHashFilePerms(path string) error {
+	if !b.checkSidecarPerms {
+		return nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read attributes of %q", path)
+	}
+
+	if info.Mode().Perm()&0022 != 0 {
+		return errors.Errorf(
+			"%q is writable by its group or others (mode %v); refusing to trust its hash",
+			path, info.Mode().Perm())
+	}
+	return nil
+}
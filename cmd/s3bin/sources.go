@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+)
+
+// probeTimeout is how long a source has to answer the latency probe.
+const probeTimeout = 2 * time.Second
+
+// source is a bucket, and the region it is in, that objects can be read
+// from, as given to -sources.
+type source struct {
+	region string
+	bucket string
+
+	latency time.Duration
+	err     error
+}
+
+// parseSources parses the -sources flag, a comma-separated list of
+// region=bucket pairs.
+func parseSources(s string) ([]*source, error) {
+	var sources []*source
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, errors.Errorf("invalid -sources entry %q: must be region=bucket", pair)
+		}
+		sources = append(sources, &source{region: parts[0], bucket: parts[1]})
+	}
+	return sources, nil
+}
+
+// selectSource switches to whichever of sources, the replicas of the same
+// objects, answers fastest. Each source is probed once, all at once, with a
+// HeadBucket request. Sources that fail to answer, or answer with an error,
+// are skipped, so that reads fail over to the others.
+func (b *s3Bin) selectSource(sources []*source) error {
+	var wg sync.WaitGroup
+	for _, src := range sources {
+		wg.Add(1)
+		go func(src *source) {
+			defer wg.Done()
+			src.latency, src.err = b.probeSource(src)
+		}(src)
+	}
+	wg.Wait()
+
+	var best *source
+	for _, src := range sources {
+		if src.err != nil {
+			log.Printf("Skipping source %s=%s: %v", src.region, src.bucket, src.err)
+			continue
+		}
+		if best == nil || src.latency < best.latency {
+			best = src
+		}
+	}
+	if best == nil {
+		return errors.New("none of the -sources could be reached")
+	}
+
+	log.Printf("Reading from %s=%s (%v)", best.region, best.bucket,
+		best.latency.Round(time.Millisecond))
+	b.s3Bucket = best.bucket
+	b.setRegion(best.region)
+	return nil
+}
+
+// probeSource returns how long src takes to answer a request.
+func (b *s3Bin) probeSource(src *source) (time.Duration, error) {
+	cli := s3.New(b.sess, &aws.Config{
+		Region: aws.String(src.region),
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+
+	start := time.Now()
+	_, err := cli.HeadBucketWithContext(ctx, &s3.HeadBucketInput{
+		Bucket: aws.String(src.bucket),
+	})
+	if err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
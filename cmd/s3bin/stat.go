@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/pkg/errors"
+)
+
+// ObjectStat describes a stored object.
+type ObjectStat struct {
+	Key          string    `json:"key"`
+	Hash         string    `json:"hash"`
+	Format       string    `json:"format"`
+	StoredSize   int64     `json:"stored_size"`
+	LastModified time.Time `json:"last_modified"`
+
+	// VersionID is the object's version in versioned buckets.
+	VersionID string `json:"version_id,omitempty"`
+
+	// Size is the size of the content, or -1 if it is unknown.
+	Size int64 `json:"size"`
+
+	// Mode is the file mode stored with the content, if any.
+	Mode string `json:"mode,omitempty"`
+
+	// Name is the file name recorded with -record-name, if any.
+	Name string `json:"name,omitempty"`
+
+	// Chunks is the number of chunks of chunked objects.
+	Chunks int `json:"chunks,omitempty"`
+}
+
+// Stat prints information about the object for file to w, as text or as
+// JSON. file is a .sha1 file, or with -lock-file, the file itself. Only the
+// beginning of the object, which holds its header, is downloaded, unless
+// the header does not fit in it.
+func (b *s3Bin) Stat(w io.Writer, file string, asJSON bool) error {
+	hash, err := b.recordedHash(file)
+	if err != nil {
+		return err
+	}
+
+	stat, err := b.statObject(hash)
+	if err != nil {
+		return err
+	}
+
+	if asJSON {
+		data, err := json.MarshalIndent(stat, "", "  ")
+		if err != nil {
+			return errors.Wrap(err, "json.MarshalIndent(stat)")
+		}
+		_, err = fmt.Fprintf(w, "%s\n", data)
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "Key:\t%s\n", stat.Key)
+	fmt.Fprintf(tw, "Hash:\t%s\n", stat.Hash)
+	fmt.Fprintf(tw, "Format:\t%s\n", stat.Format)
+	fmt.Fprintf(tw, "Stored size:\t%d\n", stat.StoredSize)
+	if stat.Size >= 0 {
+		fmt.Fprintf(tw, "Size:\t%d\n", stat.Size)
+	}
+	if stat.Mode != "" {
+		fmt.Fprintf(tw, "Mode:\t%s\n", stat.Mode)
+	}
+	if stat.Name != "" {
+		fmt.Fprintf(tw, "Name:\t%s\n", stat.Name)
+	}
+	if stat.Chunks > 0 {
+		fmt.Fprintf(tw, "Chunks:\t%d\n", stat.Chunks)
+	}
+	if stat.VersionID != "" && stat.VersionID != "null" {
+		fmt.Fprintf(tw, "Version:\t%s\n", stat.VersionID)
+	}
+	fmt.Fprintf(tw, "Last modified:\t%s\n", stat.LastModified.Format(time.RFC3339))
+	return tw.Flush()
+}
+
+// statObject reads the header of the object for hash, from the range of
+// the object DumpHeader reads.
+func (b *s3Bin) statObject(hash string) (*ObjectStat, error) {
+	key, err := b.objectKey(hash)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := b.statObjectRange(key, hash, headerRange)
+	if err != nil && errors.Cause(err) != ErrObjectNotFound {
+		// The header may be cut off by the range, and S3 rejects ranges of
+		// empty objects.
+		stat, err = b.statObjectRange(key, hash, "")
+	}
+	return stat, err
+}
+
+// statObjectRange is statObject for the byte range rng of the object at
+// key, or if rng is empty, all of it.
+func (b *s3Bin) statObjectRange(key, hash, rng string) (*ObjectStat, error) {
+	ctx, cancel := b.objectContext()
+	defer cancel()
+
+	res, err := b.getObjectRange(ctx, key, b.versionID, rng)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	content, err := b.openContent(ctx, res)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %q", key)
+	}
+
+	// The length of a ranged response is that of the range. The object's
+	// is reported after the slash of its Content-Range, e.g.
+	// "bytes 0-65535/1048576".
+	storedSize := aws.Int64Value(res.ContentLength)
+	if rng != "" {
+		contentRange := aws.StringValue(res.ContentRange)
+		total := contentRange[strings.LastIndex(contentRange, "/")+1:]
+		storedSize, err = strconv.ParseInt(total, 10, 64)
+		if err != nil {
+			return nil, errors.Errorf("%q has invalid content range %q", key, contentRange)
+		}
+	}
+
+	stat := &ObjectStat{
+		Key:          key,
+		Hash:         hash,
+		Format:       content.format,
+		StoredSize:   storedSize,
+		LastModified: aws.TimeValue(res.LastModified),
+		VersionID:    aws.StringValue(res.VersionId),
+		Size:         content.size,
+	}
+	if content.format == formatRaw {
+		stat.Size = storedSize
+	}
+
+	if content.hasMode {
+		stat.Mode = content.mode.String()
+	}
+	if content.header != nil {
+		stat.Name = content.header.Name
+	}
+	if content.manifest != nil {
+		stat.Chunks = len(content.manifest.Chunks)
+	}
+
+	return stat, nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// statCacheFile is the name of the stat cache in the -cache-dir directory.
+const statCacheFile = "stat-cache"
+
+// racyWindow is how long after its last modification a file's hash is not
+// cached. A file modified again within the file system's timestamp
+// granularity keeps its modification time, and the change would go
+// unnoticed.
+const racyWindow = 2 * time.Second
+
+// statCache maps the size and modification time of local files to their
+// hashes, so that checking whether a file is up-to-date does not need to
+// hash it again. Like the resume manifest, the cache is a file of JSON lines
+// which is only ever appended to. The last record for a path wins.
+// Processes sharing -cache-dir append to it concurrently: each record is
+// appended with a single write to the O_APPEND file, and a partial record,
+// as read while another process writes it, is skipped.
+type statCache struct {
+	mu      sync.Mutex
+	f       *os.File
+	entries map[string]manifestEntry
+
+	// bufSize is the -io-buffer-size files are hashed with.
+	bufSize int
+}
+
+func openStatCache(dir string, bufSize int) (*statCache, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create cache directory %q", dir)
+	}
+
+	path := filepath.Join(dir, statCacheFile)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open stat cache %q", path)
+	}
+
+	c := &statCache{
+		f:       f,
+		entries: make(map[string]manifestEntry),
+		bufSize: bufSize,
+	}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry manifestEntry
+		if json.Unmarshal(scanner.Bytes(), &entry) != nil {
+			continue
+		}
+		c.entries[entry.Path] = entry
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, errors.Wrapf(err, "failed to read stat cache %q", path)
+	}
+
+	return c, nil
+}
+
+func (c *statCache) Close() error {
+	return c.f.Close()
+}
+
+// hash returns the hash of file. It is taken from the cache if the file's
+// size and modification time match the cached record, and otherwise
+// computed and cached.
+func (c *statCache) hash(file string) (string, error) {
+	absPath, err := filepath.Abs(file)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to resolve %q", file)
+	}
+
+	fstat, err := os.Stat(file)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to read file attributes")
+	}
+
+	c.mu.Lock()
+	entry, ok := c.entries[absPath]
+	c.mu.Unlock()
+
+	if ok && fstat.Size() == entry.Size && fstat.ModTime().UnixNano() == entry.ModTime {
+		return entry.Hash, nil
+	}
+
+	hash, err := calcSha1(file, c.bufSize)
+	if err != nil {
+		return "", err
+	}
+
+	// The file may have changed while it was hashed. It is then hashed
+	// again next time.
+	after, err := os.Stat(file)
+	if err != nil || after.Size() != fstat.Size() || !after.ModTime().Equal(fstat.ModTime()) ||
+		time.Since(fstat.ModTime()) < racyWindow {
+		return hash, nil
+	}
+
+	entry = manifestEntry{
+		Path:    absPath,
+		Hash:    hash,
+		Size:    fstat.Size(),
+		ModTime: fstat.ModTime().UnixNano(),
+	}
+
+	line, err := json.Marshal(&entry)
+	if err != nil {
+		return "", errors.Wrap(err, "json.Marshal(entry)")
+	}
+	line = append(line, '\n')
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries[absPath] = entry
+
+	// Failing to cache the hash only makes the next check slower.
+	c.f.Write(line)
+	return hash, nil
+}
+
+// localHash returns the hash of the local file, through the stat cache if
+// -cache-dir is set.
+func (b *s3Bin) localHash(file string) (string, error) {
+	if b.statCache != nil {
+		return b.statCache.hash(file)
+	}
+	return calcSha1(file, b.ioBufferSize)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io"
+	"sync/atomic"
+)
+
+// Stats counts the work done by an s3Bin.
+type Stats struct {
+	// BytesUploaded and BytesDownloaded count the bytes of stored objects
+	// transferred to and from S3. Stored objects are usually compressed, so
+	// these can differ from the size of the files put or restored.
+	BytesUploaded   int64 `json:"bytes_uploaded"`
+	BytesDownloaded int64 `json:"bytes_downloaded"`
+
+	// S3Calls counts the HTTP requests sent to S3, including retries.
+	S3Calls int64 `json:"s3_calls"`
+
+	// FilesUploaded, FilesDownloaded and FilesSkipped count the files put,
+	// downloaded, and skipped because they were already up-to-date.
+	FilesUploaded   int64 `json:"files_uploaded"`
+	FilesDownloaded int64 `json:"files_downloaded"`
+	FilesSkipped    int64 `json:"files_skipped"`
+}
+
+// Stats returns the work done so far. It is safe to call while other
+// operations are in progress.
+func (b *s3Bin) Stats() Stats {
+	return Stats{
+		BytesUploaded:   atomic.LoadInt64(&b.stats.BytesUploaded),
+		BytesDownloaded: atomic.LoadInt64(&b.stats.BytesDownloaded),
+		S3Calls:         atomic.LoadInt64(&b.stats.S3Calls),
+		FilesUploaded:   atomic.LoadInt64(&b.stats.FilesUploaded),
+		FilesDownloaded: atomic.LoadInt64(&b.stats.FilesDownloaded),
+		FilesSkipped:    atomic.LoadInt64(&b.stats.FilesSkipped),
+	}
+}
+
+// countingReadCloser adds the number of bytes read through it to n.
+type countingReadCloser struct {
+	io.ReadCloser
+	n *int64
+}
+
+func (c *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
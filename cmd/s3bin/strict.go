@@ -0,0 +1,100 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// strictFormatError prefixes the errors of objects rejected by
+// -strict-format.
+const strictFormatError = "object does not match the strict format"
+
+// maxHeaderSize is the largest header member accepted by -strict-format.
+const maxHeaderSize = 1 << 20
+
+// checkStrictMember checks that hdr, the tar header of the index-th member
+// of an object, is a plain file member with the given name, as written by
+// s3bin. Anything else, such as links, devices or data members with file
+// type bits in their mode, is rejected.
+func checkStrictMember(hdr *tar.Header, name string, index int) error {
+	fail := func(format string, args ...interface{}) error {
+		return errors.Errorf("%s: member %d (%q): %s", strictFormatError, index,
+			hdr.Name, errors.Errorf(format, args...))
+	}
+
+	if hdr.Name != name {
+		return fail("expected name %q", name)
+	}
+	if hdr.Typeflag != tar.TypeReg {
+		return fail("type %q is not a regular file", hdr.Typeflag)
+	}
+	if hdr.Linkname != "" {
+		return fail("has link name %q", hdr.Linkname)
+	}
+	if hdr.Size < 0 || (name == "header" && hdr.Size > maxHeaderSize) {
+		return fail("size %d is out of range", hdr.Size)
+	}
+	if os.FileMode(hdr.Mode)&os.ModeType != 0 {
+		return fail("mode %v is not that of a regular file", os.FileMode(hdr.Mode))
+	}
+	return nil
+}
+
+// decodeStrict decodes the single JSON value read from r into v, rejecting
+// fields v does not have and any data after the value.
+func decodeStrict(r io.Reader, v interface{}) error {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+	if err != nil {
+		return errors.Wrap(err, strictFormatError)
+	}
+
+	var extra json.RawMessage
+	if dec.Decode(&extra) != io.EOF {
+		return errors.Errorf("%s: unexpected data after JSON value", strictFormatError)
+	}
+	return nil
+}
+
+// finishStrict is finish for -strict-format: the object must end right
+// after its content, without further tar members or trailing bytes.
+func (c *objectContent) finishStrict() error {
+	if c.tar != nil {
+		hdr, err := c.tar.Next()
+		if err == nil {
+			return errors.Errorf("%s: unexpected member %q after 'data'",
+				strictFormatError, hdr.Name)
+		} else if err != io.EOF {
+			return errors.Wrap(err, "tarReader.Next")
+		}
+	}
+
+	if c.stream != nil {
+		n, err := io.Copy(ioutil.Discard, c.stream)
+		if err != nil {
+			return errors.Wrap(err, "failed to decompress object")
+		}
+		// s3bin's archives end with the two zero blocks the tar reader
+		// consumes as the end marker, so anything left is unexpected.
+		if n > 0 {
+			return errors.Errorf("%s: %d unexpected bytes after the tar archive",
+				strictFormatError, n)
+		}
+	}
+
+	n, err := io.Copy(ioutil.Discard, c.body)
+	if err != nil {
+		return err
+	}
+	if n > 0 && c.stream != nil {
+		return errors.Errorf("%s: %d unexpected bytes after the gzip stream",
+			strictFormatError, n)
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// The results of files in a summary.
+const (
+	resultDownloaded   = "downloaded"
+	resultUploaded     = "uploaded"
+	resultSkipped      = "skipped"
+	resultLinked       = "linked"
+	resultFailed       = "failed"
+	resultVerified     = "verified"
+	resultRepaired     = "repaired"
+	resultUnrepairable = "unrepairable"
+)
+
+// Summary is the content of the -summary-out file, written once s3bin is
+// done, for CI jobs to keep and check.
+type Summary struct {
+	// Mode is the mode flag s3bin was run with, e.g. "get-dir".
+	Mode    string `json:"mode"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+	Stats   Stats  `json:"stats"`
+
+	// Files are the files s3bin worked on, in the order it was done with
+	// them.
+	Files []FileResult `json:"files"`
+}
+
+// FileResult is what became of a single file.
+type FileResult struct {
+	Path   string `json:"path"`
+	Hash   string `json:"hash"`
+	Result string `json:"result"`
+	Error  string `json:"error,omitempty"`
+}
+
+// summary accumulates the results of files for the -summary-out file. A nil
+// *summary discards them. It is safe for concurrent use.
+type summary struct {
+	mu    sync.Mutex
+	files []FileResult
+}
+
+// add records the result of the file at path, which has the given hash.
+// err is the error the file failed with, if any.
+func (s *summary) add(path, hash, result string, err error) {
+	if s == nil {
+		return
+	}
+
+	file := FileResult{
+		Path:   path,
+		Hash:   hash,
+		Result: result,
+	}
+	if err != nil {
+		file.Error = err.Error()
+	}
+
+	s.mu.Lock()
+	s.files = append(s.files, file)
+	s.mu.Unlock()
+}
+
+// modeFlags are the flags that select what s3bin does.
+var modeFlags = []string{
+	"get", "get-stdout", "get-dir", "get-sidecar-stdin", "put", "promote",
+	"list-orphans", "mirror", "touch", "repack", "presign", "stat", "compare", "repair", "get-key",
+	"import", "dump-header", "dump-object", "selftest",
+}
+
+// currentMode returns the first of modeFlags that was set on the command
+// line.
+func currentMode() string {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	for _, name := range modeFlags {
+		if set[name] {
+			return name
+		}
+	}
+	return ""
+}
+
+// writeSummary writes the summary of a run that ended with err to path.
+func (b *s3Bin) writeSummary(path string, err error) error {
+	out := &Summary{
+		Mode:    currentMode(),
+		Success: err == nil,
+		Stats:   b.Stats(),
+		Files:   []FileResult{},
+	}
+	if err != nil {
+		out.Error = err.Error()
+	}
+
+	b.summary.mu.Lock()
+	out.Files = append(out.Files, b.summary.files...)
+	b.summary.mu.Unlock()
+
+	data, jsonErr := json.MarshalIndent(out, "", "  ")
+	if jsonErr != nil {
+		return errors.Wrap(jsonErr, "json.MarshalIndent(summary)")
+	}
+	return writeFileAtomic(path, append(data, '\n'), 0644)
+}
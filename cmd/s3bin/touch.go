@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+)
+
+// Touch resets the last-modified time of the object for file, e.g. to keep
+// it from expiring under a lifecycle policy, by copying it over itself. The
+// copy is done server-side, so the object is not uploaded again. The chunks
+// of chunked objects are touched as well.
+func (b *s3Bin) Touch(file string) error {
+	hash, err := b.recordedHash(file)
+	if err != nil {
+		return err
+	}
+
+	key, err := b.objectKey(hash)
+	if err != nil {
+		return err
+	}
+	head, err := b.touchKey(key)
+	if err != nil {
+		return err
+	}
+
+	if metadataValue(head.Metadata, formatMetadata) == formatChunked {
+		manifest, err := b.readManifest(key)
+		if err != nil {
+			return err
+		}
+
+		for _, chunk := range manifest.Chunks {
+			chunkKey, err := b.objectKey(chunk.Hash)
+			if err != nil {
+				return err
+			}
+			_, err = b.touchKey(chunkKey)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	log.Printf("Touched %q", key)
+	return nil
+}
+
+// touchKey copies the object at key over itself, and returns the object's
+// properties from before the copy.
+//
+// S3 only allows copying an object over itself if something about it
+// changes, so the metadata is replaced, with the object's own. Replacing
+// the metadata also replaces the headers stored with it, which are carried
+// over as well. The copy is conditional on the object's ETag, so that an
+// object written in the meantime is not overwritten with stale metadata.
+func (b *s3Bin) touchKey(key string) (*s3.HeadObjectOutput, error) {
+	head, err := b.s3Cli.HeadObject(&s3.HeadObjectInput{
+		Bucket:       aws.String(b.s3Bucket),
+		Key:          aws.String(key),
+		RequestPayer: b.requestPayer,
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %q in S3 bucket %q",
+			key, b.s3Bucket)
+	}
+
+	input := &s3.CopyObjectInput{
+		Bucket:             aws.String(b.s3Bucket),
+		Key:                aws.String(key),
+		CopySource:         aws.String(copySource(b.s3Bucket, key)),
+		CopySourceIfMatch:  head.ETag,
+		MetadataDirective:  aws.String(s3.MetadataDirectiveReplace),
+		Metadata:           head.Metadata,
+		CacheControl:       head.CacheControl,
+		ContentDisposition: head.ContentDisposition,
+		ContentEncoding:    head.ContentEncoding,
+		ContentLanguage:    head.ContentLanguage,
+		ContentType:        head.ContentType,
+		StorageClass:       head.StorageClass,
+		RequestPayer:       b.requestPayer,
+	}
+
+	// Copies are encrypted with the bucket's default, unless told otherwise.
+	if aws.StringValue(head.ServerSideEncryption) == s3.ServerSideEncryptionAwsKms {
+		input.ServerSideEncryption = head.ServerSideEncryption
+		input.SSEKMSKeyId = head.SSEKMSKeyId
+	}
+
+	// Copies do not keep the source's ACL.
+	if b.acl != nil {
+		input.ACL = b.acl
+	}
+
+	_, err = b.s3Cli.CopyObject(input)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to touch %q in S3 bucket %q",
+			key, b.s3Bucket)
+	}
+
+	return head, nil
+}
+
+// readManifest downloads the chunk manifest of the chunked object at key.
+func (b *s3Bin) readManifest(key string) (*chunkManifest, error) {
+	res, err := b.getObject(context.Background(), key)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	manifest := &chunkManifest{}
+	err = json.NewDecoder(res.Body).Decode(manifest)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read chunk manifest of %q", key)
+	}
+
+	if manifest.Version != chunkManifestVersion {
+		return nil, errors.Errorf(
+			"unsupported chunk manifest version %d", manifest.Version)
+	}
+	return manifest, nil
+}
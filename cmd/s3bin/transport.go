@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// newHTTPClient returns the HTTP client shared by all S3 requests. Its
+// transport has the settings of http.DefaultTransport, except for its
+// connection limits: at most maxConnsPerHost connections to a host, or any
+// number if 0, of which maxIdleConnsPerHost are kept open for reuse.
+//
+// The default transport keeps only 2 idle connections per host, so workers
+// issuing requests at once, e.g. with -concurrency, would otherwise open a
+// new connection for most requests, and close it right after.
+func newHTTPClient(maxConnsPerHost, maxIdleConnsPerHost int) *http.Client {
+	idleConns := 100
+	if maxIdleConnsPerHost > idleConns {
+		idleConns = maxIdleConnsPerHost
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   30 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			MaxIdleConns:          idleConns,
+			MaxIdleConnsPerHost:   maxIdleConnsPerHost,
+			MaxConnsPerHost:       maxConnsPerHost,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: 1 * time.Second,
+		},
+	}
+}
+
+// setHTTPClient makes all S3 requests, including those of clients created
+// later from the session, use client.
+func (b *s3Bin) setHTTPClient(client *http.Client) {
+	b.sess.Config.HTTPClient = client
+	b.setRegion(aws.StringValue(b.s3Cli.Config.Region))
+}
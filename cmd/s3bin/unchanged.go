@@ -0,0 +1,35 @@
+package main
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// isUnchanged returns whether the file at path, which has the given hash,
+// is already put: its hash is the one recorded for it, and the object for
+// the hash is stored. With -skip-unchanged, Put does nothing for such
+// files. A file whose hash is not recorded, or not validly in its .sha1
+// file, is not unchanged; other failures to read the recorded hash, such as
+// a corrupt lock file, are returned.
+func (b *s3Bin) isUnchanged(path, hash string) (bool, error) {
+	var recorded string
+	var err error
+	if b.lockFile != "" {
+		recorded, err = b.lockedHash(path)
+	} else {
+		recorded, err = b.readSidecar(path + ".sha1")
+	}
+	if err != nil {
+		cause := errors.Cause(err)
+		if os.IsNotExist(cause) || cause == ErrInvalidSidecar || cause == ErrNotLocked {
+			return false, nil
+		}
+		return false, err
+	}
+
+	if recorded != hash {
+		return false, nil
+	}
+	return b.objectExists(hash)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"log"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+)
+
+// verifyObject downloads the object stored for hash, and checks that its
+// contents are readable and match the hash.
+func (b *s3Bin) verifyObject(ctx context.Context, hash string) error {
+	key, err := b.objectKey(hash)
+	if err != nil {
+		return err
+	}
+	return b.verifyKey(ctx, key, hash)
+}
+
+// verifyKey is verifyObject for the object stored under key.
+func (b *s3Bin) verifyKey(ctx context.Context, key, hash string) error {
+	res, err := b.getObject(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	content, err := b.openContent(ctx, res)
+	if err != nil {
+		return err
+	}
+
+	h := sha1.New()
+	n, err := io.Copy(h, content.data)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read %q", key)
+	}
+
+	err = content.checkSize(n)
+	if err == nil {
+		err = content.finish()
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to read %q", key)
+	}
+
+	actual := hex.EncodeToString(h.Sum(nil))
+	if actual != hash {
+		return errors.Wrapf(ErrHashMismatch, "object %q has hash %s, expected %s", key, actual, hash)
+	}
+
+	return nil
+}
+
+// deleteObject deletes the object stored for hash.
+func (b *s3Bin) deleteObject(hash string) error {
+	key, err := b.objectKey(hash)
+	if err != nil {
+		return err
+	}
+	return b.deleteKey(key)
+}
+
+// deleteKey deletes the object stored under key.
+func (b *s3Bin) deleteKey(key string) error {
+	_, err := b.s3Cli.DeleteObject(&s3.DeleteObjectInput{
+		Bucket:       aws.String(b.s3Bucket),
+		Key:          aws.String(key),
+		RequestPayer: b.requestPayer,
+	})
+	if err != nil {
+		return errors.Wrapf(b.explainLocked(key, err), "failed to delete %q from S3 bucket %q",
+			key, b.s3Bucket)
+	}
+
+	log.Printf("Deleted %q", key)
+	return nil
+}
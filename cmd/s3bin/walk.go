@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// forEachRecorded calls fn for every file under root with a recorded hash:
+// the files of the .sha1 files under root, or with -lock-file, the files
+// under root in the lock file.
+func (b *s3Bin) forEachRecorded(root string, fn func(file, hash string) error) error {
+	if b.lockFile != "" {
+		return b.forEachLocked(root, fn)
+	}
+
+	return filepath.Walk(
+		root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			if info.IsDir() || filepath.Ext(path) != ".sha1" {
+				return nil
+			}
+
+			hash, err := b.readSidecar(path)
+			if err != nil {
+				return err
+			}
+
+			return fn(strings.TrimSuffix(path, ".sha1"), hash)
+		})
+}
+
+// forEachHash calls fn for every hash in hashes, from up to -concurrency
+// goroutines at once. It returns the first error returned by fn, once every
+// call has returned.
+func (b *s3Bin) forEachHash(hashes []string, fn func(hash string) error) error {
+	ch := make(chan string)
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	for i := 0; i < b.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for hash := range ch {
+				err := fn(hash)
+				if err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, hash := range hashes {
+		ch <- hash
+	}
+	close(ch)
+	wg.Wait()
+
+	return firstErr
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// readXattrs returns the extended attributes of path. Attributes that the
+// caller is not privileged to read are not listed by the kernel, and so are
+// silently skipped. File systems without extended attributes yield none.
+func readXattrs(path string) (map[string][]byte, error) {
+	buf, err := getXattrValue(func(dest []byte) (int, error) {
+		return syscall.Listxattr(path, dest)
+	})
+	if err == syscall.ENOTSUP {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var attrs map[string][]byte
+	for _, name := range strings.Split(string(buf), "\x00") {
+		if name == "" {
+			continue
+		}
+
+		value, err := getXattrValue(func(dest []byte) (int, error) {
+			return syscall.Getxattr(path, name, dest)
+		})
+		if err == syscall.ENODATA {
+			// Removed since it was listed.
+			continue
+		} else if err != nil {
+			return nil, errors.Wrapf(err, "failed to read %q", name)
+		}
+
+		if attrs == nil {
+			attrs = make(map[string][]byte)
+		}
+		attrs[name] = value
+	}
+
+	return attrs, nil
+}
+
+// getXattrValue calls get first to size and then to fill a buffer, retrying
+// if the value grows in between.
+func getXattrValue(get func(dest []byte) (int, error)) ([]byte, error) {
+	for {
+		size, err := get(nil)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return []byte{}, nil
+		}
+
+		buf := make([]byte, size)
+		size, err = get(buf)
+		if err == syscall.ERANGE {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		return buf[:size], nil
+	}
+}
+
+// writeXattrs sets the extended attributes of path.
+func writeXattrs(path string, attrs map[string][]byte) error {
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		err := syscall.Setxattr(path, name, attrs[name], 0)
+		if err != nil {
+			return errors.Wrapf(err, "failed to set %q", name)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"log"
+
+	"github.com/pkg/errors"
+)
+
+// readXattrs is not supported on this platform. Files are put without their
+// extended attributes.
+func readXattrs(path string) (map[string][]byte, error) {
+	log.Printf("Extended attributes are not supported on this platform, skipping %q", path)
+	return nil, nil
+}
+
+func writeXattrs(path string, attrs map[string][]byte) error {
+	return errors.New("extended attributes are not supported on this platform")
+}
@@ -3,8 +3,6 @@ module github.com/dcaiafa/s3bin
 go 1.12
 
 require (
-	github.com/aws/aws-sdk-go v1.19.6
-	github.com/pkg/errors v0.8.1
-	github.com/stretchr/testify v1.3.0 // indirect
-	golang.org/x/net v0.0.0-20190328230028-74de082e2cca // indirect
+	github.com/aws/aws-sdk-go v1.44.100
+	github.com/pkg/errors v0.9.1
 )